@@ -0,0 +1,226 @@
+package joak
+
+import(
+	`time`
+	`sort`
+	`sync`
+	`bytes`
+	`errors`
+	`strconv`
+	`net/http`
+	`io/ioutil`
+	`encoding/json`
+	`github.com/0xor1/oak`
+	gctx `github.com/gorilla/context`
+)
+
+type actionLogKey int
+
+const _ACTION_LOG_KEY actionLogKey = 0
+
+// A successful act on an entity, or when Act is nil, a snapshot of the entity after any other change such as create, join, match, leave or kick.
+type ActionLogEntry struct{
+	EntityId	string			`json:"entityId"`
+	Version		int				`json:"version"`
+	UserId		string			`json:"userId,omitempty"`
+	Act			oak.Json		`json:"act,omitempty"`
+	Snapshot	json.RawMessage	`json:"snapshot,omitempty"`
+	At			time.Time		`json:"at"`
+}
+
+// Logs each change to an entity before the response for it is sent. The entity has already been written by then, so a
+// failure to append is reported through Hooks.OnError and the next change to the entity is logged as a snapshot, which
+// Replay can start from, rather than as an act.
+func WithActionLog() Option {
+	return func(c *config) {
+		gaps := &actionLogGaps{entities: map[string]bool{}}
+		c.wrappers = append(c.wrappers, func(r *http.Request, es oak.EntityStore) oak.EntityStore {
+			rec, ok := gctx.Get(r, _ACTION_LOG_KEY).(*actionRecorder)
+			if !ok {
+				return es
+			}
+			rec.store, _ = es.(*entityStore)
+			return &recordingStore{es, rec, c.clock}
+		})
+		c.middleware = append(c.middleware, func(env *routeEnv, path string, next http.Handler) http.Handler {
+			if !containsString([]string{_CREATE, _JOIN, _POLL, _ACT, _LEAVE, _MATCH}, path) {
+				return next
+			}
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				act := oak.Json{}
+				if path == _ACT && r.Body != nil {
+					d, _ := ioutil.ReadAll(r.Body)
+					r.Body = ioutil.NopCloser(bytes.NewReader(d))
+					json.Unmarshal(d, &act)
+				}
+				userId := env.getSessionString(r, _USER_ID)
+				rec := &actionRecorder{}
+				gctx.Set(r, _ACTION_LOG_KEY, rec)
+				bw := &bufferedWriter{header: http.Header{}, status: http.StatusOK}
+				next.ServeHTTP(bw, r)
+				if rec.store == nil || len(rec.entries) == 0 {
+					bw.flush(w)
+					return
+				}
+				entityId := rec.entries[0].EntityId
+				if last := rec.entries[len(rec.entries) - 1]; path == _ACT && bw.status == http.StatusOK && !gaps.has(entityId) {
+					last.UserId = userId
+					last.Act = act
+					last.Snapshot = nil
+				}
+				if err := rec.store.appendLog(rec.entries); err != nil {
+					gaps.set(entityId, true)
+					c.hooks.fail(`appendLog`, entityId, err)
+				} else {
+					gaps.set(entityId, false)
+				}
+				bw.flush(w)
+			})
+		})
+	}
+}
+
+// Entities whose last append failed, so the versions it held are missing from their log.
+type actionLogGaps struct{
+	mtx			sync.Mutex
+	entities	map[string]bool
+}
+
+func (g *actionLogGaps) has(entityId string) bool {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	return g.entities[entityId]
+}
+
+func (g *actionLogGaps) set(entityId string, gap bool) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if gap {
+		g.entities[entityId] = true
+	} else {
+		delete(g.entities, entityId)
+	}
+}
+
+type actionRecorder struct{
+	store	*entityStore
+	entries	[]*ActionLogEntry
+}
+
+type recordingStore struct{
+	oak.EntityStore
+	rec		*actionRecorder
+	clock	Clock
+}
+
+func (rs *recordingStore) Create() (string, oak.Entity, error) {
+	id, e, err := rs.EntityStore.Create()
+	if err == nil {
+		rs.record(id, e)
+	}
+	return id, e, err
+}
+
+func (rs *recordingStore) Update(entityId string, e oak.Entity) error {
+	err := rs.EntityStore.Update(entityId, e)
+	if err == nil {
+		rs.record(entityId, e)
+	}
+	return err
+}
+
+func (rs *recordingStore) record(entityId string, e oak.Entity) {
+	snapshot, _ := json.Marshal(e)
+	rs.rec.entries = append(rs.rec.entries, &ActionLogEntry{EntityId: entityId, Version: e.GetVersion(), Snapshot: snapshot, At: rs.clock.Now()})
+}
+
+func ReadActionLog(store oak.EntityStore, entityId string) ([]*ActionLogEntry, error) {
+	es, ok := store.(*entityStore)
+	if !ok {
+		return nil, errors.New(`store must be a joak entity store`)
+	}
+	return es.readLog(entityId)
+}
+
+// Rebuilds the entity at version from the latest logged snapshot at or before it and the logged acts after that snapshot.
+func Replay(store oak.EntityStore, entityId string, version int, performAct oak.PerformAct) (Entity, error) {
+	entries, err := ReadActionLog(store, entityId)
+	if err != nil {
+		return nil, err
+	}
+	start := -1
+	for i, entry := range entries {
+		if entry.Version > version {
+			break
+		}
+		if entry.Act == nil {
+			start = i
+		}
+	}
+	if start == -1 {
+		return nil, errors.New(`no snapshot at or before version ` + strconv.Itoa(version) + ` for entity with id "` + entityId + `"`)
+	}
+	e := store.(*entityStore).ef()
+	if err = json.Unmarshal(entries[start].Snapshot, e); err != nil {
+		return nil, err
+	}
+	for _, entry := range entries[start + 1:] {
+		if e.GetVersion() == version {
+			break
+		}
+		if entry.Version != e.GetVersion() + 1 {
+			return nil, errors.New(`action log for entity with id "` + entityId + `" is missing version ` + strconv.Itoa(e.GetVersion() + 1))
+		}
+		if err = performAct(entry.Act, entry.UserId, e); err != nil {
+			return nil, err
+		}
+		e.IncrementVersion()
+	}
+	if e.GetVersion() != version {
+		return nil, errors.New(`action log for entity with id "` + entityId + `" does not reach version ` + strconv.Itoa(version))
+	}
+	return e, nil
+}
+
+type actionLogByVersion []*ActionLogEntry
+
+func (l actionLogByVersion) Len() int { return len(l) }
+func (l actionLogByVersion) Less(i, j int) bool { return l[i].Version < l[j].Version }
+func (l actionLogByVersion) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+
+func sortActionLog(entries []*ActionLogEntry) {
+	sort.Stable(actionLogByVersion(entries))
+}
+
+type actionLogRecord struct{
+	Version		int
+	UserId		string		`datastore:",noindex"`
+	Act			[]byte		`datastore:",noindex"`
+	Snapshot	[]byte		`datastore:",noindex"`
+	At			time.Time	`datastore:",noindex"`
+}
+
+func newActionLogRecord(entry *ActionLogEntry) (*actionLogRecord, error) {
+	record := &actionLogRecord{Version: entry.Version, UserId: entry.UserId, Snapshot: entry.Snapshot, At: entry.At}
+	if entry.Act != nil {
+		act, err := json.Marshal(entry.Act)
+		if err != nil {
+			return nil, err
+		}
+		record.Act = act
+	}
+	return record, nil
+}
+
+func (r *actionLogRecord) entry(entityId string) (*ActionLogEntry, error) {
+	entry := &ActionLogEntry{EntityId: entityId, Version: r.Version, UserId: r.UserId, At: r.At}
+	if len(r.Act) > 0 {
+		if err := json.Unmarshal(r.Act, &entry.Act); err != nil {
+			return nil, err
+		}
+	}
+	if len(r.Snapshot) > 0 {
+		entry.Snapshot = r.Snapshot
+	}
+	return entry, nil
+}
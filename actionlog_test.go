@@ -0,0 +1,155 @@
+package joak
+
+import(
+	`time`
+	`bytes`
+	`errors`
+	`testing`
+	`net/http`
+	`encoding/json`
+	`net/http/cookiejar`
+	`net/http/httptest`
+	`github.com/0xor1/oak`
+	`github.com/gorilla/mux`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_WithActionLog(t *testing.T){
+	dur, _ := time.ParseDuration(`1m`)
+	router := mux.NewRouter()
+	routes := RouteLocalTest(router, func()Entity{return &actTestEntity{}}, func(e Entity)Entity{return e}, 300, `test`, `auth`, `crypt-key-0123456789abcdefghijkl`, ``, ``, &actTestEntity{}, actTestResp, actTestResp, actTestPerformAct, dur, WithActionLog())
+	server := httptest.NewServer(router)
+	defer server.Close()
+	c1, c2 := newTestClient(server), newTestClient(server)
+
+	id := c1.post(`/create`, nil)[`id`].(string)
+	c2.post(`/join`, oak.Json{`id`: id})
+	c1.post(`/act`, oak.Json{`n`: 2})
+	c2.post(`/act`, oak.Json{`n`: 3})
+	c2.post(`/act`, oak.Json{`n`: -1})
+	c1.post(`/act`, oak.Json{`n`: 4})
+
+	r, _ := http.NewRequest(`GET`, `/`, nil)
+	store := routes.EntityStore(r)
+	entries, err := ReadActionLog(store, id)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, 5, len(entries), `create, join and three successful acts should have been logged`)
+	assert.NotNil(t, entries[0].Snapshot, `create should be logged as a snapshot`)
+	assert.NotNil(t, entries[1].Snapshot, `join should be logged as a snapshot`)
+	assert.Equal(t, oak.Json{`n`: float64(3)}, entries[3].Act, `act should be logged`)
+	assert.Equal(t, `1`, entries[3].UserId, `acting user should be logged`)
+	assert.Equal(t, 3, entries[3].Version, `resulting version should be logged`)
+
+	e, err := Replay(store, id, 3, actTestPerformAct)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, 3, e.GetVersion(), `replayed entity should be at the requested version`)
+	assert.Equal(t, 5, e.(*actTestEntity).Count, `replayed entity should have the acts up to the requested version applied`)
+
+	e, _ = Replay(store, id, 4, actTestPerformAct)
+	current, _ := store.Read(id)
+
+	assert.Equal(t, current.GetVersion(), e.GetVersion(), `replaying to the current version should rebuild the current entity`)
+	assert.Equal(t, current.(*actTestEntity).Count, e.(*actTestEntity).Count, `replaying to the current version should rebuild the current entity`)
+	assert.Equal(t, current.(*actTestEntity).Players, e.(*actTestEntity).Players, `replaying to the current version should rebuild the current entity`)
+
+	_, err = Replay(store, id, 5, actTestPerformAct)
+
+	assert.Equal(t, `action log for entity with id "` + id + `" does not reach version 5`, err.Error(), `err should have appropriate message`)
+}
+
+func Test_WithActionLog_appendError(t *testing.T){
+	router := mux.NewRouter()
+	failures := []string{}
+	routes := RouteLocalTest(router, func()Entity{return &actTestEntity{}}, func(e Entity)Entity{return e}, 300, `test`, `auth`, `crypt-key-0123456789abcdefghijkl`, ``, ``, &actTestEntity{}, actTestResp, actTestResp, actTestPerformAct, time.Hour, WithActionLog(), WithHooks(Hooks{OnError: func(hook string, entityId string, err error){
+		failures = append(failures, hook + `: ` + err.Error())
+	}}))
+	server := httptest.NewServer(router)
+	defer server.Close()
+	c := newTestClient(server)
+	r, _ := http.NewRequest(`GET`, `/`, nil)
+	store := routes.EntityStore(r).(*entityStore)
+	appendLog := store.appendLog
+
+	id := c.post(`/create`, nil)[`id`].(string)
+	c.post(`/act`, oak.Json{`n`: 1})
+	store.appendLog = func(entries []*ActionLogEntry) error { return errors.New(`log unavailable`) }
+	c.post(`/act`, oak.Json{`n`: 1})
+	store.appendLog = appendLog
+	c.post(`/act`, oak.Json{`n`: 1})
+	c.post(`/act`, oak.Json{`n`: 1})
+
+	assert.Equal(t, []string{`appendLog: log unavailable`}, failures, `append errors should be reported`)
+
+	e, err := Replay(store, id, 4, actTestPerformAct)
+
+	assert.Nil(t, err, `replay should restart from the snapshot logged after the gap`)
+	assert.Equal(t, 4, e.(*actTestEntity).Count, `replayed entity should have every act applied`)
+
+	_, err = Replay(store, id, 2, actTestPerformAct)
+
+	assert.Equal(t, `action log for entity with id "` + id + `" is missing version 2`, err.Error(), `versions in the gap can not be replayed`)
+}
+
+type testClient struct{
+	url		string
+	http	*http.Client
+}
+
+func newTestClient(server *httptest.Server) *testClient {
+	jar, _ := cookiejar.New(nil)
+	return &testClient{server.URL, &http.Client{Jar: jar}}
+}
+
+func (c *testClient) post(path string, body oak.Json) oak.Json {
+	d, _ := json.Marshal(body)
+	resp, err := c.http.Post(c.url + path, `application/json`, bytes.NewReader(d))
+	respJson := oak.Json{}
+	if err == nil {
+		json.NewDecoder(resp.Body).Decode(&respJson)
+		resp.Body.Close()
+	}
+	return respJson
+}
+
+// Posts body with header set on the request, the response is nil when the request fails.
+func (c *testClient) do(path string, header http.Header, body oak.Json) (*http.Response, oak.Json) {
+	d, _ := json.Marshal(body)
+	r, _ := http.NewRequest(`POST`, c.url + path, bytes.NewReader(d))
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	respJson := oak.Json{}
+	resp, err := c.http.Do(r)
+	if err != nil {
+		return nil, respJson
+	}
+	json.NewDecoder(resp.Body).Decode(&respJson)
+	resp.Body.Close()
+	return resp, respJson
+}
+
+type actTestEntity struct{
+	testEntity
+	Count	int
+	Players	int
+}
+
+func (e *actTestEntity) RegisterNewUser() (string, error) {
+	e.Players++
+	return string('0' + rune(e.Players)), nil
+}
+
+func actTestResp(userId string, e oak.Entity) oak.Json {
+	return oak.Json{`count`: e.(*actTestEntity).Count}
+}
+
+func actTestPerformAct(json oak.Json, userId string, e oak.Entity) error {
+	n, _ := json[`n`].(float64)
+	if n < 0 {
+		return errors.New(`n must not be negative`)
+	}
+	e.(*actTestEntity).Count += int(n)
+	return nil
+}
@@ -0,0 +1,126 @@
+package joak
+
+import(
+	`io`
+	`time`
+	`errors`
+	`strconv`
+	`encoding/json`
+	`github.com/0xor1/oak`
+)
+
+type archiveRecord struct{
+	Id			string			`json:"id"`
+	Version		int				`json:"version"`
+	DeleteAfter	time.Time		`json:"deleteAfter"`
+	CreatedAt	time.Time		`json:"createdAt,omitempty"`
+	Entity		json.RawMessage	`json:"entity"`
+}
+
+func Export(w io.Writer, store oak.EntityStore) (count int, err error) {
+	es, ok := store.(*entityStore)
+	if !ok {
+		return 0, errors.New(`store must be a joak entity store`)
+	}
+	ids, deleteAfters, err := es.list(es.clock.Now())
+	if err != nil {
+		return 0, err
+	}
+	enc := json.NewEncoder(w)
+	for i, id := range ids {
+		e, err := es.Read(id)
+		if err != nil {
+			if isNonExtantError(err) {
+				continue
+			}
+			return count, err
+		}
+		d, err := json.Marshal(e)
+		if err != nil {
+			return count, err
+		}
+		var createdAt time.Time
+		if es.trackLifetime {
+			r, err := es.readLifetime(id)
+			if err != nil {
+				return count, err
+			}
+			if r != nil {
+				createdAt = r.CreatedAt
+			}
+		}
+		if err = enc.Encode(&archiveRecord{id, e.GetVersion(), deleteAfters[i], createdAt, d}); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// Writes each entity as Create would, keeping its lifetime and rebuilding its history and lobby and matchmaking entries.
+// OnCreate is not run as the entities were created in the store they were exported from.
+func Import(r io.Reader, store oak.EntityStore) (count int, err error) {
+	es, ok := store.(*entityStore)
+	if !ok {
+		return 0, errors.New(`store must be a joak entity store`)
+	}
+	dec := json.NewDecoder(r)
+	at := es.clock.Now()
+	for n := 1;; n++ {
+		rec := archiveRecord{}
+		if err = dec.Decode(&rec); err == io.EOF {
+			return count, nil
+		} else if err != nil {
+			return count, &archiveRecordError{n, err}
+		}
+		if rec.Id == `` {
+			return count, &archiveRecordError{n, errors.New(`id must not be an empty string`)}
+		}
+		if !rec.DeleteAfter.After(at) {
+			continue
+		}
+		e := es.ef()
+		if err = json.Unmarshal(rec.Entity, e); err != nil {
+			return count, &archiveRecordError{n, err}
+		}
+		if e.GetVersion() != rec.Version {
+			return count, &archiveRecordError{n, errors.New(`entity version does not match record version`)}
+		}
+		deleteAfter := rec.DeleteAfter
+		if es.trackLifetime {
+			// archives exported without lifetimes start them now
+			r := &lifetimeRecord{CreatedAt: rec.CreatedAt, IdleUntil: deleteAfter}
+			if r.CreatedAt.IsZero() {
+				r.CreatedAt = at
+			}
+			if end := es.lifetimeEnd(r); !end.IsZero() && end.Before(r.IdleUntil) {
+				r.IdleUntil = end
+			}
+			if !r.IdleUntil.After(at) {
+				continue
+			}
+			if err = es.putLifetime(rec.Id, r); err != nil {
+				return count, err
+			}
+			deleteAfter = r.IdleUntil
+		}
+		e.SetDeleteAfter(deleteAfter)
+		if err = es.put(rec.Id, e, deleteAfter); err != nil {
+			return count, err
+		}
+		if es.cache != nil {
+			es.cache.remove(rec.Id)
+		}
+		es.recordHistory(rec.Id, e)
+		es.indexOpen(rec.Id, e)
+		es.indexLobby(rec.Id, e)
+		count++
+	}
+}
+
+type archiveRecordError struct{
+	record	int
+	inner	error
+}
+
+func (e *archiveRecordError) Error() string { return `archive record ` + strconv.Itoa(e.record) + `: ` + e.inner.Error() }
@@ -0,0 +1,104 @@
+package joak
+
+import(
+	`time`
+	`bytes`
+	`strings`
+	`testing`
+	`net/http`
+	`github.com/gorilla/mux`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_ExportImport(t *testing.T){
+	dur, _ := time.ParseDuration(`1m`)
+	ef := func()Entity{return &testEntity{}}
+	ei := func(e Entity)Entity{return e}
+	r, _ := http.NewRequest(`GET`, `/`, nil)
+	src := RouteLocalTest(mux.NewRouter(), ef, ei, 300, ``, ``, ``, ``, `test`, &testEntity{}, nil, nil, nil, dur).EntityStore(r)
+	dst := newMemoryStore(ef, ei, dur, newConfig(nil))
+
+	id1, e1, _ := src.Create()
+	id2, e2, _ := src.Create()
+	src.Update(id2, e2)
+	src.Update(id2, e2)
+
+	buf := &bytes.Buffer{}
+	count, err := Export(buf, src)
+
+	assert.Equal(t, 2, count, `count should be 2`)
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, 2, strings.Count(buf.String(), "\n"), `archive should have one line per entity`)
+
+	count, err = Import(buf, dst)
+
+	assert.Equal(t, 2, count, `count should be 2`)
+	assert.Nil(t, err, `err should be nil`)
+
+	e, err := dst.Read(id1)
+
+	assert.Equal(t, e1.GetVersion(), e.GetVersion(), `version should be preserved`)
+	assert.Nil(t, err, `err should be nil`)
+
+	e, err = dst.Read(id2)
+
+	assert.Equal(t, 2, e.GetVersion(), `version should be preserved`)
+	assert.Nil(t, err, `err should be nil`)
+
+	err = dst.Update(id2, e)
+
+	assert.Equal(t, 3, e.GetVersion(), `imported entities should accept sequential updates`)
+	assert.Nil(t, err, `err should be nil`)
+}
+
+func Test_ExportImport_lifetime(t *testing.T){
+	clock := NewFakeClock(now())
+	ef := func()Entity{return &testEntity{}}
+	ei := func(e Entity)Entity{return e}
+	src := newMemoryStore(ef, ei, time.Hour, newConfig([]Option{WithClock(clock), WithLifetime(time.Hour, 0)})).(*entityStore)
+	dst := newMemoryStore(ef, ei, time.Hour, newConfig([]Option{WithClock(clock), WithLifetime(time.Hour, 0), WithHistory(5)})).(*entityStore)
+	createdAt := clock.Now()
+	id, e, _ := src.Create()
+	clock.Advance(30 * time.Minute)
+	src.Update(id, e)
+
+	buf := &bytes.Buffer{}
+	Export(buf, src)
+	count, err := Import(buf, dst)
+	r, _ := dst.readLifetime(id)
+	snapshot, _ := dst.readHistory(id, 1)
+
+	assert.Equal(t, 1, count, `count should be 1`)
+	assert.Nil(t, err, `err should be nil`)
+	assert.True(t, createdAt.Equal(r.CreatedAt), `the lifetime should survive the move`)
+	assert.NotNil(t, snapshot, `the history should be rebuilt`)
+
+	clock.Advance(30 * time.Minute)
+	e, err = dst.Read(id)
+
+	assert.Nil(t, e, `the entity should expire at the end of its original lifetime`)
+	assert.True(t, isNonExtantError(err), `err should be a non extant error`)
+}
+
+func Test_Import_errors(t *testing.T){
+	dur, _ := time.ParseDuration(`1m`)
+	dst := newMemoryStore(func()Entity{return &testEntity{}}, func(e Entity)Entity{return e}, dur, newConfig(nil))
+	future := now().Add(dur).Format(time.RFC3339Nano)
+
+	_, err := Import(strings.NewReader(`{"id":"a","version":1,"deleteAfter":"`+future+`","entity":{"Version":2}}`), dst)
+
+	assert.Equal(t, `archive record 1: entity version does not match record version`, err.Error(), `err should have appropriate message`)
+
+	_, err = Import(strings.NewReader(`{"version":1}`), dst)
+
+	assert.Equal(t, `archive record 1: id must not be an empty string`, err.Error(), `err should have appropriate message`)
+
+	count, err := Import(strings.NewReader(`{"id":"a","version":1,"deleteAfter":"2000-01-01T00:00:00Z","entity":{"Version":1}}`), dst)
+
+	assert.Equal(t, 0, count, `expired records should be skipped`)
+	assert.Nil(t, err, `err should be nil`)
+
+	_, err = Export(&bytes.Buffer{}, nil)
+
+	assert.Equal(t, `store must be a joak entity store`, err.Error(), `err should have appropriate message`)
+}
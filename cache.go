@@ -0,0 +1,115 @@
+package joak
+
+import(
+	`time`
+	`sync`
+	`errors`
+	`container/list`
+)
+
+type Cloner interface{
+	Clone() Entity
+}
+
+// Keeps up to size recently used entities in memory. The memory store serves them straight from the cache, the sql store
+// first checks the cached version is still the stored one as other processes may share the database, and the gae store
+// does not use the cache as nds already caches entities in memcache. Cached entities are handed out as clones, copying
+// them any other way costs as much as reading the store, so the entity must implement Cloner.
+func WithCache(size int) Option {
+	return func(c *config) {
+		c.cacheSize = size
+	}
+}
+
+func (c *config) requireCloner(entity Entity) {
+	if _, ok := entity.(Cloner); c.err == nil && c.cacheSize > 0 && !ok {
+		c.err = errors.New(`WithCache requires the entity to implement Cloner`)
+	}
+}
+
+func cloneEntity(e Entity) (Entity, bool) {
+	c, ok := e.(Cloner)
+	if !ok {
+		return nil, false
+	}
+	return c.Clone(), true
+}
+
+type cacheEntry struct{
+	id			string
+	entity		Entity
+	deleteAfter	time.Time
+}
+
+type entityCache struct{
+	mtx		sync.Mutex
+	size	int
+	order	*list.List
+	entries	map[string]*list.Element
+}
+
+func newEntityCache(size int) *entityCache {
+	return &entityCache{
+		size: size,
+		order: list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+func (c *entityCache) get(id string, at time.Time) Entity {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	el, exists := c.entries[id]
+	if !exists {
+		return nil
+	}
+	ce := el.Value.(*cacheEntry)
+	if !at.Before(ce.deleteAfter) {
+		c.order.Remove(el)
+		delete(c.entries, id)
+		return nil
+	}
+	c.order.MoveToFront(el)
+	return ce.entity
+}
+
+func (c *entityCache) set(id string, e Entity, deleteAfter time.Time) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if el, exists := c.entries[id]; exists {
+		ce := el.Value.(*cacheEntry)
+		if ce.entity.GetVersion() > e.GetVersion() {
+			return
+		}
+		ce.entity = e
+		ce.deleteAfter = deleteAfter
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[id] = c.order.PushFront(&cacheEntry{id, e, deleteAfter})
+	for c.order.Len() > c.size {
+		el := c.order.Back()
+		c.order.Remove(el)
+		delete(c.entries, el.Value.(*cacheEntry).id)
+	}
+}
+
+func (c *entityCache) remove(id string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if el, exists := c.entries[id]; exists {
+		c.order.Remove(el)
+		delete(c.entries, id)
+	}
+}
+
+func (c *entityCache) removeExpired(at time.Time) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for id, el := range c.entries {
+		if !at.Before(el.Value.(*cacheEntry).deleteAfter) {
+			c.order.Remove(el)
+			delete(c.entries, id)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package joak
+
+import(
+	`time`
+	`strconv`
+	`testing`
+	`github.com/gorilla/mux`
+	`golang.org/x/net/context`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_EntityCache(t *testing.T){
+	c := newEntityCache(2)
+	at := now()
+	later := at.Add(time.Minute)
+
+	c.set(`a`, &testEntity{Version: 1}, later)
+	c.set(`b`, &testEntity{Version: 1}, later)
+
+	assert.Equal(t, 1, c.get(`a`, at).GetVersion(), `a should be cached`)
+
+	c.set(`c`, &testEntity{Version: 1}, later)
+
+	assert.Nil(t, c.get(`b`, at), `b should have been evicted as least recently used`)
+	assert.NotNil(t, c.get(`a`, at), `a should still be cached`)
+	assert.NotNil(t, c.get(`c`, at), `c should be cached`)
+
+	c.set(`a`, &testEntity{Version: 0}, later)
+
+	assert.Equal(t, 1, c.get(`a`, at).GetVersion(), `an older version should not replace a newer one`)
+
+	c.remove(`a`)
+
+	assert.Nil(t, c.get(`a`, at), `a should have been removed`)
+	assert.Nil(t, c.get(`c`, later), `c should not be served once expired`)
+
+	c.set(`d`, &testEntity{Version: 1}, at)
+	c.removeExpired(at)
+
+	assert.Equal(t, 0, len(c.entries), `expired entries should have been removed`)
+}
+
+func Test_MemoryStore_WithCache(t *testing.T){
+	dur, _ := time.ParseDuration(`1s`)
+	s := newMemoryStore(func()Entity{return &cacheTestEntity{}}, func(e Entity)Entity{return e}, dur, newConfig([]Option{WithCache(10)})).(*entityStore)
+
+	id, e, err := s.Create()
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.NotNil(t, s.cache.get(id, now()), `created entity should be cached`)
+
+	err = s.Update(id, e)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, 1, s.cache.get(id, now()).GetVersion(), `cached entity should be at the updated version`)
+
+	e1, err := s.Read(id)
+	e2, _ := s.Read(id)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, 1, e1.GetVersion(), `read entity should be at the updated version`)
+	assert.True(t, e1 != e2, `each read should return its own copy`)
+
+	stale := &cacheTestEntity{}
+	err = s.Update(id, stale)
+
+	assert.NotNil(t, err, `err should not be nil`)
+	assert.Nil(t, s.cache.get(id, now()), `a failed update should invalidate the cached entity`)
+
+	s.Read(id)
+	err = s.Delete(id)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Nil(t, s.cache.get(id, now()), `a deleted entity should not be cached`)
+
+	e, err = s.Read(id)
+
+	assert.Nil(t, e, `entity should be nil`)
+	assert.NotNil(t, err, `err should not be nil`)
+}
+
+func Test_SqlStore_WithCache(t *testing.T){
+	db := newTestSqlDb(t)
+	defer db.Close()
+	newStore := func() *entityStore {
+		return newSqlStore(db, context.Background(), SqliteDialect, `joak`, `Test_SqlStore_WithCache`, func()Entity{return &cacheTestEntity{}}, func(e Entity)Entity{return e}, time.Minute, time.Minute, newConfig([]Option{WithCache(10)})).(*entityStore)
+	}
+	s1, s2 := newStore(), newStore()
+
+	id, _, _ := s1.Create()
+	e, _ := s2.Read(id)
+	s2.Update(id, e)
+	e, err := s1.Read(id)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, 1, e.GetVersion(), `an entity updated by another process should not be served from the cache`)
+	assert.Equal(t, 1, s1.cache.get(id, now()).GetVersion(), `the cache should hold the stored version`)
+
+	s2.Delete(id)
+	e, err = s1.Read(id)
+
+	assert.Nil(t, e, `an entity deleted by another process should not be served from the cache`)
+	assert.True(t, isNonExtantError(err), `err should be a non extant error`)
+}
+
+func Test_WithCache_requiresCloner(t *testing.T){
+	dur, _ := time.ParseDuration(`1s`)
+
+	assert.Panics(t, func(){
+		RouteLocalTest(mux.NewRouter(), nil, nil, 300, ``, ``, ``, ``, `test`, &testEntity{}, nil, nil, nil, dur, WithCache(10))
+	}, `an entity that is not a Cloner should be rejected`)
+	assert.NotPanics(t, func(){
+		RouteLocalTest(mux.NewRouter(), nil, nil, 300, ``, ``, ``, ``, `test`, &cacheTestEntity{}, nil, nil, nil, dur, WithCache(10))
+	}, `a Cloner should be accepted`)
+}
+
+func benchmarkMemoryStoreRead(b *testing.B, opts ...Option) {
+	s := newMemoryStore(func()Entity{return &cacheTestEntity{}}, func(e Entity)Entity{
+		for i := 0; i < 50; i++ {
+			e.(*cacheTestEntity).Players = append(e.(*cacheTestEntity).Players, `player-` + strconv.Itoa(i))
+		}
+		return e
+	}, time.Hour, newConfig(opts)).(*entityStore)
+	id, _, _ := s.Create()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := s.Read(id); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func Benchmark_MemoryStore_Read(b *testing.B) {
+	benchmarkMemoryStoreRead(b)
+}
+
+func Benchmark_MemoryStore_Read_WithCache(b *testing.B) {
+	benchmarkMemoryStoreRead(b, WithCache(10))
+}
+
+type cacheTestEntity struct{
+	testEntity
+	Players	[]string
+}
+
+func (e *cacheTestEntity) Clone() Entity {
+	c := *e
+	c.Players = append([]string{}, e.Players...)
+	return &c
+}
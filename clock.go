@@ -0,0 +1,50 @@
+package joak
+
+import(
+	`time`
+	`sync`
+)
+
+type Clock interface{
+	Now() time.Time
+}
+
+func WithClock(clock Clock) Option {
+	return func(c *config) {
+		c.clock = clock
+	}
+}
+
+type realClock struct{}
+
+func (c realClock) Now() time.Time {
+	return now()
+}
+
+// A Clock that only moves when told to, for deterministic expiry and sweep tests.
+type FakeClock struct{
+	mtx	sync.Mutex
+	t	time.Time
+}
+
+func NewFakeClock(t time.Time) *FakeClock {
+	return &FakeClock{t: t.UTC()}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.t
+}
+
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.t = c.t.Add(d)
+}
+
+func (c *FakeClock) Set(t time.Time) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.t = t.UTC()
+}
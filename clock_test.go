@@ -0,0 +1,69 @@
+package joak
+
+import(
+	`time`
+	`testing`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_FakeClock(t *testing.T){
+	start := time.Date(2015, 7, 29, 0, 0, 0, 0, time.UTC)
+	c := NewFakeClock(start)
+
+	assert.Equal(t, start, c.Now(), `Now should be the start time`)
+
+	c.Advance(time.Minute)
+
+	assert.Equal(t, start.Add(time.Minute), c.Now(), `Now should have advanced`)
+
+	c.Set(start)
+
+	assert.Equal(t, start, c.Now(), `Now should have been set`)
+}
+
+func Test_ClearOut_WithClock(t *testing.T){
+	c := NewFakeClock(time.Date(2015, 7, 29, 0, 0, 0, 0, time.UTC))
+	cfg := newConfig([]Option{WithClock(c)})
+	sweeps := 0
+	clearOut := newClearOut(`Test_ClearOut_WithClock`, time.Minute, cfg, func(){ sweeps++ })
+
+	clearOut()
+	clearOut()
+
+	assert.Equal(t, 1, sweeps, `clear out should only sweep once per clearOutAfter`)
+
+	c.Advance(59 * time.Second)
+	clearOut()
+
+	assert.Equal(t, 1, sweeps, `clear out should not sweep before clearOutAfter has passed`)
+
+	c.Advance(time.Second)
+	clearOut()
+
+	assert.Equal(t, 2, sweeps, `clear out should sweep once clearOutAfter has passed`)
+
+	newClearOut(`Test_ClearOut_WithClock`, time.Minute, newConfig([]Option{WithClock(c)}), func(){ sweeps++ })()
+
+	assert.Equal(t, 3, sweeps, `clear outs of separately configured stores should not share their last sweep`)
+}
+
+func Test_MemoryStore_WithClock(t *testing.T){
+	c := NewFakeClock(time.Date(2015, 7, 29, 0, 0, 0, 0, time.UTC))
+	s := newMemoryStore(func()Entity{return &cacheTestEntity{}}, func(e Entity)Entity{return e}, time.Minute, newConfig([]Option{WithClock(c), WithCache(10)})).(*entityStore)
+
+	id, e, _ := s.Create()
+	c.Advance(30 * time.Second)
+	s.Update(id, e)
+
+	assert.Equal(t, c.Now().Add(time.Minute), e.(*cacheTestEntity).DeleteAfter, `Update should refresh DeleteAfter from the clock`)
+
+	ids, _, _ := s.list(c.Now())
+
+	assert.Equal(t, []string{id}, ids, `entity should be live`)
+
+	c.Advance(time.Minute)
+	ids, _, _ = s.list(c.Now())
+
+	assert.Equal(t, 0, len(ids), `entity should have expired`)
+	assert.Nil(t, s.cache.get(id, c.Now()), `expired entity should not be served from the cache`)
+}
@@ -0,0 +1,125 @@
+package joak
+
+import(
+	`time`
+	`net/http`
+	`database/sql`
+	`github.com/0xor1/oak`
+	`golang.org/x/net/context`
+	gctx `github.com/gorilla/context`
+)
+
+type requestContextKey int
+
+const _REQUEST_CONTEXT_KEY requestContextKey = 0
+
+// Gives the store calls made while handling each request a deadline of timeout, they are also cancelled when the client disconnects.
+func WithStoreTimeout(timeout time.Duration) Option {
+	return func(c *config) {
+		c.storeTimeout = timeout
+	}
+}
+
+// The entity store with each call taking the context it runs under, calls fail with ctx.Err() once ctx is done.
+// On GAE ctx must be derived from an appengine context.
+type ContextEntityStore interface{
+	Create(ctx context.Context) (string, oak.Entity, error)
+	Read(ctx context.Context, entityId string) (oak.Entity, error)
+	Update(ctx context.Context, entityId string, e oak.Entity) error
+	Delete(ctx context.Context, entityId string) error
+}
+
+func (rs *Routes) ContextEntityStore() ContextEntityStore {
+	return &contextEntityStore{rs.storeForContext}
+}
+
+type contextEntityStore struct{
+	storeForContext	func(ctx context.Context) *entityStore
+}
+
+func (cs *contextEntityStore) Create(ctx context.Context) (string, oak.Entity, error) {
+	return cs.storeForContext(ctx).Create()
+}
+
+func (cs *contextEntityStore) Read(ctx context.Context, entityId string) (oak.Entity, error) {
+	return cs.storeForContext(ctx).Read(entityId)
+}
+
+func (cs *contextEntityStore) Update(ctx context.Context, entityId string, e oak.Entity) error {
+	return cs.storeForContext(ctx).Update(entityId, e)
+}
+
+func (cs *contextEntityStore) Delete(ctx context.Context, entityId string) error {
+	return cs.storeForContext(ctx).Delete(entityId)
+}
+
+func (es *entityStore) withContext(ctx context.Context) *entityStore {
+	c := *es
+	c.ctx = ctx
+	return &c
+}
+
+func requestContext(r *http.Request) context.Context {
+	return r.Context()
+}
+
+func requestContextHandler(contextFactory ContextFactory, timeout time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := contextFactory(r)
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		gctx.Set(r, _REQUEST_CONTEXT_KEY, ctx)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Returns the context set for the request by the route wiring, or a new one for requests joak isn't handling.
+func storeContext(r *http.Request, contextFactory ContextFactory) context.Context {
+	if ctx, ok := gctx.Get(r, _REQUEST_CONTEXT_KEY).(context.Context); ok {
+		return ctx
+	}
+	return contextFactory(r)
+}
+
+// Keeps the values of the context it wraps, which on GAE carry the appengine context, but is never done, so background work
+// started while handling a request is not cancelled when the request finishes.
+type detachedContext struct{
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+// Runs every statement under ctx so that cancelling a request stops its queries.
+type contextDB struct{
+	*sql.DB
+	ctx	context.Context
+}
+
+func (db *contextDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.ExecContext(db.ctx, query, args...)
+}
+
+func (db *contextDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return db.QueryContext(db.ctx, query, args...)
+}
+
+func (db *contextDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return db.QueryRowContext(db.ctx, query, args...)
+}
+
+func (db *contextDB) Begin() (*sql.Tx, error) {
+	return db.BeginTx(db.ctx, nil)
+}
@@ -0,0 +1,73 @@
+package joak
+
+import(
+	`time`
+	`testing`
+	`net/http`
+	`net/http/httptest`
+	`github.com/gorilla/mux`
+	`golang.org/x/net/context`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_RouteLocalTest_ContextEntityStore(t *testing.T){
+	routes := RouteLocalTest(mux.NewRouter(), func()Entity{return &testEntity{}}, func(e Entity)Entity{return e}, 300, ``, ``, ``, ``, ``, &testEntity{}, nil, nil, nil, time.Hour)
+	s := routes.ContextEntityStore()
+
+	id, e, err := s.Create(context.Background())
+
+	assert.Nil(t, err, `Create should succeed with a live context`)
+
+	err = s.Update(context.Background(), id, e)
+	read, _ := s.Read(context.Background(), id)
+
+	assert.Nil(t, err, `Update should succeed with a live context`)
+	assert.Equal(t, 1, read.GetVersion(), `calls should share the same store`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err = s.Create(ctx)
+
+	assert.Equal(t, context.Canceled, err, `Create should fail once the context is done`)
+
+	_, err = s.Read(ctx, id)
+
+	assert.Equal(t, context.Canceled, err, `Read should fail once the context is done`)
+
+	err = s.Update(ctx, id, read)
+
+	assert.Equal(t, context.Canceled, err, `Update should fail once the context is done`)
+
+	err = s.Delete(ctx, id)
+	_, readErr := s.Read(context.Background(), id)
+
+	assert.Equal(t, context.Canceled, err, `Delete should fail once the context is done`)
+	assert.Nil(t, readErr, `a cancelled Delete should not delete the entity`)
+}
+
+func Test_WithStoreTimeout(t *testing.T){
+	var deadline time.Time
+	var hasDeadline bool
+	h := requestContextHandler(requestContext, time.Minute, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deadline, hasDeadline = storeContext(r, requestContext).Deadline()
+	}))
+	start := time.Now()
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(`POST`, `/act`, nil))
+
+	assert.True(t, hasDeadline, `store calls should be given a deadline`)
+	assert.True(t, !deadline.Before(start.Add(time.Minute)) && deadline.Before(time.Now().Add(time.Minute)), `the deadline should be the store timeout from the start of the request`)
+}
+
+func Test_detachedContext(t *testing.T){
+	parent, cancel := context.WithTimeout(context.WithValue(context.Background(), `key`, `value`), time.Minute)
+	ctx := detachedContext{parent}
+	cancel()
+	_, hasDeadline := ctx.Deadline()
+
+	assert.NotNil(t, parent.Err(), `the parent should be cancelled`)
+	assert.Nil(t, ctx.Err(), `a detached context should not be cancelled with its parent`)
+	assert.Nil(t, ctx.Done(), `a detached context should never be done`)
+	assert.False(t, hasDeadline, `a detached context should have no deadline`)
+	assert.Equal(t, `value`, ctx.Value(`key`), `a detached context should keep the values of its parent`)
+}
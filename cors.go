@@ -0,0 +1,102 @@
+package joak
+
+import(
+	`time`
+	`errors`
+	`strconv`
+	`strings`
+	`net/http`
+)
+
+type Cors struct{
+	AllowedOrigins		[]string
+	AllowCredentials	bool
+	AllowedMethods		[]string
+	AllowedHeaders		[]string
+	ExposedHeaders		[]string
+	MaxAge				time.Duration
+}
+
+// AllowedOrigins may contain * to allow any origin, but not when AllowCredentials is true as any site could then make
+// requests with the user's session, the route functions return an error for that combination.
+func WithCors(cors Cors) Option {
+	return func(c *config) {
+		if cors.AllowCredentials && containsString(cors.AllowedOrigins, `*`) {
+			c.err = errors.New(`cors AllowedOrigins must not contain * when AllowCredentials is true`)
+			return
+		}
+		if len(cors.AllowedMethods) == 0 {
+			cors.AllowedMethods = []string{`GET`, `POST`}
+		}
+		if len(cors.AllowedHeaders) == 0 {
+			cors.AllowedHeaders = []string{`Content-Type`, _CSRF_HEADER, _IDEMPOTENCY_KEY, `If-Match`, `If-None-Match`}
+		}
+		c.cors = &cors
+	}
+}
+
+func (c *Cors) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get(`Origin`)
+		if origin == `` {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h := w.Header()
+		h.Add(`Vary`, `Origin`)
+		preflight := r.Method == `OPTIONS` && r.Header.Get(`Access-Control-Request-Method`) != ``
+		if !c.allowsOrigin(origin) {
+			if preflight {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		if containsString(c.AllowedOrigins, `*`) && !c.AllowCredentials {
+			h.Set(`Access-Control-Allow-Origin`, `*`)
+		} else {
+			h.Set(`Access-Control-Allow-Origin`, origin)
+		}
+		if c.AllowCredentials {
+			h.Set(`Access-Control-Allow-Credentials`, `true`)
+		}
+		if !preflight {
+			if len(c.ExposedHeaders) > 0 {
+				h.Set(`Access-Control-Expose-Headers`, strings.Join(c.ExposedHeaders, `, `))
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !containsFold(c.AllowedMethods, r.Header.Get(`Access-Control-Request-Method`)) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		for _, header := range strings.Split(r.Header.Get(`Access-Control-Request-Headers`), `,`) {
+			if header = strings.TrimSpace(header); header != `` && !containsFold(c.AllowedHeaders, header) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+		h.Set(`Access-Control-Allow-Methods`, strings.Join(c.AllowedMethods, `, `))
+		h.Set(`Access-Control-Allow-Headers`, strings.Join(c.AllowedHeaders, `, `))
+		if c.MaxAge > 0 {
+			h.Set(`Access-Control-Max-Age`, strconv.Itoa(int(c.MaxAge.Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// Credentialed requests are only allowed from origins that are listed explicitly.
+func (c *Cors) allowsOrigin(origin string) bool {
+	return (!c.AllowCredentials && containsString(c.AllowedOrigins, `*`)) || containsFold(c.AllowedOrigins, origin)
+}
+
+func containsFold(strs []string, str string) bool {
+	for _, s := range strs {
+		if strings.EqualFold(s, str) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package joak
+
+import(
+	`time`
+	`testing`
+	`net/http`
+	`net/http/httptest`
+	`github.com/gorilla/mux`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_WithCors(t *testing.T){
+	router := mux.NewRouter()
+	dur, _ := time.ParseDuration(`1s`)
+	maxAge, _ := time.ParseDuration(`10m`)
+	RouteLocalTest(router, func()Entity{return &testEntity{}}, func(e Entity)Entity{return e}, 300, `test`, ``, ``, ``, ``, &testEntity{}, nil, nil, nil, dur, WithPostOnly(), WithCors(Cors{AllowedOrigins: []string{`https://cdn.example.com`}, AllowCredentials: true, ExposedHeaders: []string{`Retry-After`}, MaxAge: maxAge}))
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest(`OPTIONS`, `/act`, nil)
+	r.Header.Set(`Origin`, `https://cdn.example.com`)
+	r.Header.Set(`Access-Control-Request-Method`, `POST`)
+	r.Header.Set(`Access-Control-Request-Headers`, `content-type`)
+	router.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusNoContent, w.Code, `preflight should be answered`)
+	assert.Equal(t, `https://cdn.example.com`, w.Header().Get(`Access-Control-Allow-Origin`), `origin should be echoed`)
+	assert.Equal(t, `true`, w.Header().Get(`Access-Control-Allow-Credentials`), `credentials should be allowed`)
+	assert.Equal(t, `GET, POST`, w.Header().Get(`Access-Control-Allow-Methods`), `default methods should be allowed`)
+	assert.Equal(t, `600`, w.Header().Get(`Access-Control-Max-Age`), `max age should be set in seconds`)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest(`OPTIONS`, `/act`, nil)
+	r.Header.Set(`Origin`, `https://cdn.example.com`)
+	r.Header.Set(`Access-Control-Request-Method`, `DELETE`)
+	router.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusForbidden, w.Code, `disallowed methods should be refused`)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest(`POST`, `/create`, nil)
+	r.Header.Set(`Origin`, `https://cdn.example.com`)
+	router.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code, `cross origin requests should be served`)
+	assert.Equal(t, `https://cdn.example.com`, w.Header().Get(`Access-Control-Allow-Origin`), `origin should be echoed`)
+	assert.Equal(t, `Retry-After`, w.Header().Get(`Access-Control-Expose-Headers`), `exposed headers should be set`)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest(`POST`, `/create`, nil)
+	r.Header.Set(`Origin`, `https://evil.example.com`)
+	router.ServeHTTP(w, r)
+
+	assert.Equal(t, ``, w.Header().Get(`Access-Control-Allow-Origin`), `unknown origins should not be allowed`)
+}
+
+func Test_WithCors_credentialsWithAnyOrigin(t *testing.T){
+	dur, _ := time.ParseDuration(`1s`)
+	cors := WithCors(Cors{AllowedOrigins: []string{`*`}, AllowCredentials: true})
+
+	assert.Equal(t, `cors AllowedOrigins must not contain * when AllowCredentials is true`, newConfig([]Option{cors}).err.Error(), `* should be rejected with credentials`)
+	assert.Panics(t, func(){
+		RouteLocalTest(mux.NewRouter(), nil, nil, 300, ``, ``, ``, ``, `test`, &testEntity{}, nil, nil, nil, dur, cors)
+	}, `* should be rejected with credentials`)
+
+	h := (&Cors{AllowedOrigins: []string{`*`, `https://cdn.example.com`}, AllowCredentials: true}).handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request){}))
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest(`POST`, `/act`, nil)
+	r.Header.Set(`Origin`, `https://evil.example.com`)
+	h.ServeHTTP(w, r)
+
+	assert.Equal(t, ``, w.Header().Get(`Access-Control-Allow-Origin`), `credentialed requests should only be allowed from listed origins`)
+	assert.Equal(t, ``, w.Header().Get(`Access-Control-Allow-Credentials`), `credentialed requests should only be allowed from listed origins`)
+
+	w = httptest.NewRecorder()
+	r.Header.Set(`Origin`, `https://cdn.example.com`)
+	h.ServeHTTP(w, r)
+
+	assert.Equal(t, `https://cdn.example.com`, w.Header().Get(`Access-Control-Allow-Origin`), `listed origins should be echoed`)
+}
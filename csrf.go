@@ -0,0 +1,208 @@
+package joak
+
+import(
+	`strconv`
+	`strings`
+	`net/url`
+	`net/http`
+	`crypto/rand`
+	`crypto/hmac`
+	`crypto/sha256`
+	`crypto/subtle`
+	`encoding/base64`
+	`github.com/0xor1/oak`
+)
+
+const(
+	_CSRF			= `/csrf`
+	_CSRF_HEADER	= `X-Csrf-Token`
+	_CSRF_COOKIE	= `_csrf`
+)
+
+var stateChangingPaths = []string{_CREATE, _JOIN, _ACT, _LEAVE, _MATCH, _RESUME}
+
+func WithPostOnly() Option {
+	return func(c *config) {
+		c.middleware = append(c.middleware, func(env *routeEnv, path string, next http.Handler) http.Handler {
+			if !containsString(stateChangingPaths, path) {
+				return next
+			}
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != `POST` {
+					w.Header().Set(`Allow`, `POST`)
+					http.Error(w, `method not allowed`, http.StatusMethodNotAllowed)
+					return
+				}
+				next.ServeHTTP(w, r)
+			})
+		})
+	}
+}
+
+// Adds a /csrf route returning a token, also set as a cookie, that must be sent back in the X-Csrf-Token header of state
+// changing requests. Tokens are bound to the entity and user in the session, when a request changes them a new token is
+// set as the cookie and returned in the X-Csrf-Token response header.
+func WithCsrfToken() Option {
+	return func(c *config) {
+		c.routes = append(c.routes, extraRoute{_CSRF, func(env *routeEnv) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				binding := csrfBinding(env, r)
+				token := ``
+				if cookie, err := r.Cookie(env.sessionName + _CSRF_COOKIE); err == nil && validCsrfToken(env.authKey, binding, cookie.Value) {
+					token = cookie.Value
+				} else {
+					token = newCsrfToken(env.authKey, binding)
+					http.SetCookie(w, c.csrfCookie(env, r, token))
+				}
+				writeJson(w, &oak.Json{`token`: token})
+			})
+		}})
+		c.middleware = append(c.middleware, func(env *routeEnv, path string, next http.Handler) http.Handler {
+			if !containsString(stateChangingPaths, path) {
+				return next
+			}
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == `OPTIONS` {
+					answerOptions(w)
+					return
+				}
+				header := r.Header.Get(_CSRF_HEADER)
+				cookie, err := r.Cookie(env.sessionName + _CSRF_COOKIE)
+				binding := csrfBinding(env, r)
+				if err != nil || header == `` || subtle.ConstantTimeCompare([]byte(header), []byte(cookie.Value)) != 1 || !validCsrfToken(env.authKey, binding, header) {
+					http.Error(w, `invalid csrf token`, http.StatusForbidden)
+					return
+				}
+				cw := &csrfWriter{ResponseWriter: w, refresh: func() {
+					if newBinding := csrfBinding(env, r); newBinding != binding {
+						token := newCsrfToken(env.authKey, newBinding)
+						http.SetCookie(w, c.csrfCookie(env, r, token))
+						w.Header().Set(_CSRF_HEADER, token)
+					}
+				}}
+				next.ServeHTTP(cw, r)
+				// handlers that write nothing, like /leave, have their headers written after they return
+				cw.beforeWrite()
+			})
+		})
+	}
+}
+
+func WithOriginCheck(allowedOrigins ...string) Option {
+	return func(c *config) {
+		c.middleware = append(c.middleware, func(env *routeEnv, path string, next http.Handler) http.Handler {
+			if !containsString(stateChangingPaths, path) {
+				return next
+			}
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == `OPTIONS` {
+					answerOptions(w)
+					return
+				}
+				origin := r.Header.Get(`Origin`)
+				if origin == `` {
+					if referer, err := url.Parse(r.Header.Get(`Referer`)); err == nil && referer.Host != `` {
+						origin = referer.Scheme + `://` + referer.Host
+					}
+				}
+				if !allowedOrigin(r, origin, allowedOrigins) {
+					http.Error(w, `origin not allowed`, http.StatusForbidden)
+					return
+				}
+				next.ServeHTTP(w, r)
+			})
+		})
+	}
+}
+
+// With CORS credentials the frontend may be on another site, so the cookie has to be sent cross site, the token is still
+// bound to the session and must be echoed in the header, which other sites can't read.
+func (c *config) csrfCookie(env *routeEnv, r *http.Request, token string) *http.Cookie {
+	if c.cors != nil && c.cors.AllowCredentials {
+		return &http.Cookie{Name: env.sessionName + _CSRF_COOKIE, Value: token, Path: `/`, Secure: true, SameSite: http.SameSiteNoneMode}
+	}
+	return &http.Cookie{Name: env.sessionName + _CSRF_COOKIE, Value: token, Path: `/`, Secure: secureRequest(r), SameSite: http.SameSiteStrictMode}
+}
+
+// CORS preflights are answered by the cors handler before they get here, any other OPTIONS is answered without reaching
+// oak's handlers, which would otherwise act on it.
+func answerOptions(w http.ResponseWriter) {
+	w.Header().Set(`Allow`, `POST`)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func allowedOrigin(r *http.Request, origin string, allowedOrigins []string) bool {
+	if origin == `` {
+		return false
+	}
+	if containsString(allowedOrigins, origin) {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// The session has been saved by the time the response is written, so refresh sees its new entity and user.
+type csrfWriter struct{
+	http.ResponseWriter
+	refresh		func()
+	refreshed	bool
+}
+
+func (cw *csrfWriter) WriteHeader(status int) {
+	cw.beforeWrite()
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *csrfWriter) Write(d []byte) (int, error) {
+	cw.beforeWrite()
+	return cw.ResponseWriter.Write(d)
+}
+
+func (cw *csrfWriter) beforeWrite() {
+	if !cw.refreshed {
+		cw.refreshed = true
+		cw.refresh()
+	}
+}
+
+// Quoting keeps the binding unambiguous whatever the ids contain, it is empty for requests without a session.
+func csrfBinding(env *routeEnv, r *http.Request) string {
+	entityId := env.getSessionString(r, _ENTITY_ID)
+	userId := env.getSessionString(r, _USER_ID)
+	if entityId == `` && userId == `` {
+		return ``
+	}
+	return strconv.Quote(entityId) + strconv.Quote(userId)
+}
+
+func secureRequest(r *http.Request) bool {
+	return r.TLS != nil || strings.EqualFold(r.Header.Get(`X-Forwarded-Proto`), `https`)
+}
+
+func newCsrfToken(key []byte, binding string) string {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	return base64.RawURLEncoding.EncodeToString(nonce) + `.` + base64.RawURLEncoding.EncodeToString(csrfMac(key, binding, nonce))
+}
+
+func validCsrfToken(key []byte, binding string, token string) bool {
+	parts := strings.Split(token, `.`)
+	if len(parts) != 2 {
+		return false
+	}
+	nonce, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return false
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(parts[1])
+	return err == nil && hmac.Equal(mac, csrfMac(key, binding, nonce))
+}
+
+func csrfMac(key []byte, binding string, nonce []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(`joak csrf`))
+	m.Write(nonce)
+	m.Write([]byte(binding))
+	return m.Sum(nil)
+}
@@ -0,0 +1,238 @@
+package joak
+
+import(
+	`time`
+	`strings`
+	`testing`
+	`net/url`
+	`net/http`
+	`encoding/json`
+	`net/http/httptest`
+	`github.com/0xor1/oak`
+	`github.com/gorilla/mux`
+	`github.com/stretchr/testify/assert`
+)
+
+func newCsrfTestRouter(opts ...Option) *mux.Router {
+	router := mux.NewRouter()
+	dur, _ := time.ParseDuration(`1s`)
+	RouteLocalTest(router, func()Entity{return &testEntity{}}, func(e Entity)Entity{return e}, 300, `test`, `auth`, ``, ``, ``, &testEntity{}, nil, nil, nil, dur, opts...)
+	return router
+}
+
+func Test_WithPostOnly(t *testing.T){
+	router := newCsrfTestRouter(WithPostOnly())
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest(`GET`, `/create`, nil)
+	router.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code, `GET should not be allowed`)
+	assert.Equal(t, `POST`, w.Header().Get(`Allow`), `Allow header should be set`)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest(`POST`, `/create`, nil)
+	router.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code, `POST should be allowed`)
+}
+
+func Test_WithCsrfToken(t *testing.T){
+	router := newCsrfTestRouter(WithCsrfToken())
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest(`POST`, `/create`, nil)
+	router.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusForbidden, w.Code, `requests without a token should be rejected`)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest(`GET`, `/csrf`, nil)
+	router.ServeHTTP(w, r)
+	resp := map[string]string{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	cookie := w.HeaderMap.Get(`Set-Cookie`)
+
+	assert.NotEqual(t, ``, resp[`token`], `a token should be returned`)
+	assert.Contains(t, cookie, `test_csrf=` + resp[`token`], `the token should be set as a cookie`)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest(`POST`, `/create`, nil)
+	r.AddCookie(&http.Cookie{Name: `test_csrf`, Value: resp[`token`]})
+	r.Header.Set(`X-Csrf-Token`, resp[`token`] + `x`)
+	router.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusForbidden, w.Code, `a mismatched token should be rejected`)
+
+	forged := newCsrfToken([]byte(`not the auth key`), ``)
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest(`POST`, `/create`, nil)
+	r.AddCookie(&http.Cookie{Name: `test_csrf`, Value: forged})
+	r.Header.Set(`X-Csrf-Token`, forged)
+	router.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusForbidden, w.Code, `a token not signed with the session key should be rejected`)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest(`POST`, `/create`, nil)
+	r.AddCookie(&http.Cookie{Name: `test_csrf`, Value: resp[`token`]})
+	r.Header.Set(`X-Csrf-Token`, resp[`token`])
+	router.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code, `a matching token should be accepted`)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest(`GET`, `/csrf`, nil)
+	r.Header.Set(`X-Forwarded-Proto`, `https`)
+	router.ServeHTTP(w, r)
+	cookie = w.HeaderMap.Get(`Set-Cookie`)
+
+	assert.Contains(t, cookie, `SameSite=Strict`, `the cookie should only be sent on same site requests`)
+	assert.Contains(t, cookie, `Secure`, `the cookie should be secure on https requests`)
+}
+
+func Test_WithCsrfToken_session(t *testing.T){
+	router := mux.NewRouter()
+	RouteLocalTest(router, func()Entity{return &actTestEntity{}}, func(e Entity)Entity{return e}, 300, `test`, `auth`, `crypt-key-0123456789abcdefghijkl`, ``, ``, &actTestEntity{}, actTestResp, actTestResp, actTestPerformAct, time.Hour, WithCsrfToken())
+	server := httptest.NewServer(router)
+	defer server.Close()
+	c1, c2 := newTestClient(server), newTestClient(server)
+	token := func(c *testClient) string {
+		resp, err := c.http.Get(c.url + `/csrf`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		respJson := map[string]string{}
+		json.NewDecoder(resp.Body).Decode(&respJson)
+		return respJson[`token`]
+	}
+	act := func(c *testClient, token string) int {
+		resp, _ := c.do(`/act`, http.Header{`X-Csrf-Token`: {token}}, oak.Json{`n`: 1})
+		return resp.StatusCode
+	}
+
+	resp, _ := c1.do(`/create`, http.Header{`X-Csrf-Token`: {token(c1)}}, nil)
+	t1 := resp.Header.Get(`X-Csrf-Token`)
+	c2.do(`/create`, http.Header{`X-Csrf-Token`: {token(c2)}}, nil)
+
+	assert.NotEqual(t, ``, t1, `a new token should be returned when the session changes`)
+	assert.Equal(t, t1, token(c1), `the new token should also be set as the cookie`)
+	assert.Equal(t, http.StatusOK, act(c1, t1), `a token for the session should be accepted`)
+
+	u, _ := url.Parse(server.URL)
+	c2.http.Jar.SetCookies(u, []*http.Cookie{{Name: `test_csrf`, Value: t1, Path: `/`}})
+
+	assert.Equal(t, http.StatusForbidden, act(c2, t1), `a token for another session should be rejected`)
+	assert.Equal(t, http.StatusOK, act(c2, token(c2)), `a new token should be issued for the session`)
+}
+
+func Test_WithCsrfToken_cors(t *testing.T){
+	router := newCsrfTestRouter(WithCsrfToken(), WithCors(Cors{AllowedOrigins: []string{`https://cdn.example.com`}, AllowCredentials: true}))
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest(`GET`, `/csrf`, nil)
+	r.Header.Set(`Origin`, `https://cdn.example.com`)
+	router.ServeHTTP(w, r)
+	resp := map[string]string{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	cookie := w.HeaderMap.Get(`Set-Cookie`)
+
+	assert.Contains(t, cookie, `SameSite=None`, `the cookie should be sent by the cross site frontend`)
+	assert.Contains(t, cookie, `Secure`, `SameSite=None cookies must be secure`)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest(`POST`, `/create`, nil)
+	r.Header.Set(`Origin`, `https://cdn.example.com`)
+	r.AddCookie(&http.Cookie{Name: `test_csrf`, Value: resp[`token`]})
+	r.Header.Set(`X-Csrf-Token`, resp[`token`])
+	router.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code, `a cross site request with the token should be served`)
+	assert.Equal(t, `https://cdn.example.com`, w.Header().Get(`Access-Control-Allow-Origin`), `origin should be echoed`)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest(`POST`, `/create`, nil)
+	r.Header.Set(`Origin`, `https://cdn.example.com`)
+	r.AddCookie(&http.Cookie{Name: `test_csrf`, Value: resp[`token`]})
+	router.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusForbidden, w.Code, `the cookie alone should be rejected`)
+}
+
+func Test_WithOriginCheck(t *testing.T){
+	router := newCsrfTestRouter(WithOriginCheck(`https://games.example.com`))
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest(`POST`, `http://api.example.com/create`, nil)
+	r.Header.Set(`Origin`, `https://evil.example.com`)
+	router.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusForbidden, w.Code, `unknown origins should be rejected`)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest(`POST`, `http://api.example.com/create`, nil)
+	router.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusForbidden, w.Code, `requests without Origin or Referer should be rejected`)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest(`POST`, `http://api.example.com/create`, nil)
+	r.Header.Set(`Origin`, `https://games.example.com`)
+	router.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code, `allowed origins should be accepted`)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest(`POST`, `http://api.example.com/create`, nil)
+	r.Header.Set(`Referer`, `http://api.example.com/game/1`)
+	router.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code, `same host referers should be accepted`)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest(`POST`, `http://api.example.com/poll`, nil)
+	router.ServeHTTP(w, r)
+
+	assert.NotEqual(t, http.StatusForbidden, w.Code, `poll should not be origin checked`)
+}
+
+func Test_stateChangingOptions(t *testing.T){
+	router := mux.NewRouter()
+	routes := RouteLocalTest(router, func()Entity{return &actTestEntity{}}, func(e Entity)Entity{return e}, 300, `test`, `auth`, `crypt-key-0123456789abcdefghijkl`, ``, ``, &actTestEntity{}, actTestResp, actTestResp, actTestPerformAct, time.Hour, WithPostOnly(), WithCsrfToken(), WithOriginCheck())
+	server := httptest.NewServer(router)
+	defer server.Close()
+	c := newTestClient(server)
+	options := func(path string) int {
+		r, _ := http.NewRequest(`OPTIONS`, c.url + path, strings.NewReader(`{"n": 1}`))
+		resp, err := c.http.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	count := func() int {
+		ids, _, _ := routes.EntityStore(&http.Request{}).(*entityStore).list(now())
+		return len(ids)
+	}
+
+	options(`/create`)
+
+	assert.Equal(t, 0, count(), `OPTIONS /create should not create an entity`)
+
+	resp, _ := c.http.Get(c.url + `/csrf`)
+	token := map[string]string{}
+	json.NewDecoder(resp.Body).Decode(&token)
+	resp.Body.Close()
+	resp, respJson := c.do(`/create`, http.Header{`X-Csrf-Token`: {token[`token`]}, `Origin`: {c.url}}, nil)
+	id, _ := respJson[`id`].(string)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode, `a checked POST /create should succeed`)
+
+	options(`/act`)
+	e, _ := routes.EntityStore(&http.Request{}).Read(id)
+
+	assert.Equal(t, 0, e.(*actTestEntity).Count, `OPTIONS /act should not perform the act`)
+	assert.Equal(t, 1, count(), `OPTIONS should not change anything`)
+}
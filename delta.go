@@ -0,0 +1,218 @@
+package joak
+
+import(
+	`sort`
+	`sync`
+	`bytes`
+	`strconv`
+	`strings`
+	`reflect`
+	`net/http`
+	`io/ioutil`
+	`crypto/sha256`
+	`container/list`
+	`encoding/json`
+	`encoding/base64`
+	`github.com/0xor1/oak`
+)
+
+const(
+	_PATCH				= `patch`
+	_BASE				= `base`
+	_DELTA				= `delta`
+	_JSON_PATCH_TYPE	= `application/json-patch+json`
+	_DELTA_BASE_HEADER	= `X-Delta-Base`
+)
+
+// Remembers the last versions /act and /poll responses sent to each user of an entity, for up to users pairs, and names
+// each by a hash sent in the X-Delta-Base header. A /poll sending a remembered hash as base that asks for a patch, with
+// delta true or an Accept of application/json-patch+json, gets an RFC 6902 JSON Patch in patch, with base and the
+// current version in v. Responses are held in process memory, so a poll reaching another instance gets the full response.
+func WithDeltaResponses(users int, versions int) Option {
+	return func(c *config) {
+		sent := newSentResps(users, versions)
+		c.middleware = append(c.middleware, func(env *routeEnv, path string, next http.Handler) http.Handler {
+			if path != _POLL && path != _ACT {
+				return next
+			}
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				userId := env.getSessionString(r, _USER_ID)
+				entityId := env.getSessionString(r, _ENTITY_ID)
+				base := ``
+				wantsPatch := acceptsJsonPatch(r)
+				if path == _POLL {
+					var d []byte
+					if r.Body != nil {
+						d, _ = ioutil.ReadAll(r.Body)
+						r.Body = ioutil.NopCloser(bytes.NewReader(d))
+					}
+					// read as WithPollETags does, so GET polls are understood when this is the outer middleware
+					reqJson, _ := readPollRequest(r)
+					r.Body = ioutil.NopCloser(bytes.NewReader(d))
+					entityId, _ = reqJson[_ID].(string)
+					if base, _ = reqJson[_BASE].(string); base == `` {
+						base = r.URL.Query().Get(_BASE)
+					}
+					if delta, _ := reqJson[_DELTA].(bool); delta || r.URL.Query().Get(_DELTA) == `true` {
+						wantsPatch = true
+					}
+				}
+				bw := &bufferedWriter{header: http.Header{}, status: http.StatusOK}
+				next.ServeHTTP(bw, r)
+				respJson := oak.Json{}
+				if bw.status != http.StatusOK || entityId == `` || json.Unmarshal(bw.body.Bytes(), &respJson) != nil {
+					bw.flush(w)
+					return
+				}
+				version, ok := respJson[_VERSION].(float64)
+				if !ok {
+					bw.flush(w)
+					return
+				}
+				key := sentRespKey{entityId, userId}
+				from := sent.get(key, base)
+				hash := sent.set(key, respJson)
+				bw.header.Set(_DELTA_BASE_HEADER, hash)
+				if from == nil || !wantsPatch || base == hash {
+					bw.flush(w)
+					return
+				}
+				patch := diffJson(``, from, map[string]interface{}(respJson), []oak.Json{})
+				if d, err := json.Marshal(oak.Json{_PATCH: patch, _BASE: base, _VERSION: version}); err == nil && len(d) < bw.body.Len() {
+					bw.body.Reset()
+					bw.body.Write(d)
+				}
+				bw.flush(w)
+			})
+		})
+	}
+}
+
+func acceptsJsonPatch(r *http.Request) bool {
+	for _, accept := range r.Header[`Accept`] {
+		for _, mediaType := range strings.Split(accept, `,`) {
+			if strings.TrimSpace(strings.Split(mediaType, `;`)[0]) == _JSON_PATCH_TYPE {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Appends the operations turning a into b, values must be as decoded by encoding/json.
+func diffJson(path string, a interface{}, b interface{}, ops []oak.Json) []oak.Json {
+	switch av := a.(type) {
+	case map[string]interface{}:
+		if bv, ok := b.(map[string]interface{}); ok {
+			keys := make([]string, 0, len(av) + len(bv))
+			for k := range av {
+				keys = append(keys, k)
+			}
+			for k := range bv {
+				if _, exists := av[k]; !exists {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				p := path + `/` + escapePointer(k)
+				if _, exists := bv[k]; !exists {
+					ops = append(ops, oak.Json{`op`: `remove`, `path`: p})
+				} else if _, exists := av[k]; !exists {
+					ops = append(ops, oak.Json{`op`: `add`, `path`: p, `value`: bv[k]})
+				} else {
+					ops = diffJson(p, av[k], bv[k], ops)
+				}
+			}
+			return ops
+		}
+	case []interface{}:
+		if bv, ok := b.([]interface{}); ok {
+			i := 0
+			for ; i < len(av) && i < len(bv); i++ {
+				ops = diffJson(path + `/` + strconv.Itoa(i), av[i], bv[i], ops)
+			}
+			for ; i < len(bv); i++ {
+				ops = append(ops, oak.Json{`op`: `add`, `path`: path + `/` + strconv.Itoa(i), `value`: bv[i]})
+			}
+			for j := len(av) - 1; j >= len(bv); j-- {
+				ops = append(ops, oak.Json{`op`: `remove`, `path`: path + `/` + strconv.Itoa(j)})
+			}
+			return ops
+		}
+	}
+	if !reflect.DeepEqual(a, b) {
+		ops = append(ops, oak.Json{`op`: `replace`, `path`: path, `value`: b})
+	}
+	return ops
+}
+
+func escapePointer(s string) string {
+	return strings.Replace(strings.Replace(s, `~`, `~0`, -1), `/`, `~1`, -1)
+}
+
+type sentRespKey struct{
+	entityId	string
+	userId		string
+}
+
+type sentResp struct{
+	key		sentRespKey
+	resps	map[string]interface{}
+	order	[]string
+}
+
+type sentResps struct{
+	mtx			sync.Mutex
+	users		int
+	versions	int
+	order		*list.List
+	entries		map[sentRespKey]*list.Element
+}
+
+func newSentResps(users int, versions int) *sentResps {
+	return &sentResps{
+		users: users,
+		versions: versions,
+		order: list.New(),
+		entries: map[sentRespKey]*list.Element{},
+	}
+}
+
+func (s *sentResps) get(key sentRespKey, hash string) interface{} {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if el, exists := s.entries[key]; exists {
+		return el.Value.(*sentResp).resps[hash]
+	}
+	return nil
+}
+
+// Returns the hash the response is remembered by, encoding/json sorts map keys so equal responses have equal hashes.
+func (s *sentResps) set(key sentRespKey, resp oak.Json) string {
+	d, _ := json.Marshal(resp)
+	sum := sha256.Sum256(d)
+	hash := base64.RawURLEncoding.EncodeToString(sum[:16])
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	el, exists := s.entries[key]
+	if !exists {
+		el = s.order.PushFront(&sentResp{key, map[string]interface{}{}, nil})
+		s.entries[key] = el
+		for s.order.Len() > s.users {
+			delete(s.entries, s.order.Remove(s.order.Back()).(*sentResp).key)
+		}
+	}
+	s.order.MoveToFront(el)
+	sr := el.Value.(*sentResp)
+	if _, exists := sr.resps[hash]; exists {
+		return hash
+	}
+	sr.resps[hash] = map[string]interface{}(resp)
+	sr.order = append(sr.order, hash)
+	for len(sr.order) > s.versions {
+		delete(sr.resps, sr.order[0])
+		sr.order = sr.order[1:]
+	}
+	return hash
+}
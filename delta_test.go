@@ -0,0 +1,147 @@
+package joak
+
+import(
+	`time`
+	`strconv`
+	`strings`
+	`testing`
+	`net/http`
+	`encoding/json`
+	`net/http/httptest`
+	`github.com/0xor1/oak`
+	`github.com/gorilla/mux`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_WithDeltaResponses(t *testing.T){
+	router := mux.NewRouter()
+	RouteLocalTest(router, func()Entity{return &actTestEntity{}}, func(e Entity)Entity{return e}, 300, `test`, `auth`, `crypt-key-0123456789abcdefghijkl`, ``, ``, &actTestEntity{}, actTestResp, deltaTestResp, actTestPerformAct, time.Hour, WithDeltaResponses(10, 2))
+	server := httptest.NewServer(router)
+	defer server.Close()
+	c := newTestClient(server)
+
+	id := c.post(`/create`, nil)[`id`].(string)
+	r, v1 := c.do(`/act`, nil, oak.Json{`n`: 1})
+	base := r.Header.Get(`X-Delta-Base`)
+	c.post(`/act`, oak.Json{`n`: 1})
+	full := c.post(`/poll`, oak.Json{`id`: id, `v`: -1, `delta`: true})
+	delta := c.post(`/poll`, oak.Json{`id`: id, `v`: 1, `base`: base, `delta`: true})
+
+	assert.NotEqual(t, ``, base, `responses should say which base they can be patched from`)
+	assert.Nil(t, full[`patch`], `a poll without a base should get the full response`)
+	assert.Equal(t, full, c.post(`/poll`, oak.Json{`id`: id, `v`: 1, `base`: base}), `a poll that does not ask for a patch should get the full response`)
+	assert.Nil(t, c.post(`/poll`, oak.Json{`id`: id, `v`: 1, `delta`: true})[`patch`], `a poll from a version without the response it holds should get the full response`)
+	assert.Equal(t, base, delta[`base`], `a patch should say which response it applies to`)
+	assert.Equal(t, float64(2), delta[`v`], `a patch should say which version it brings the client to`)
+	assert.Equal(t, full, applyTestPatch(t, v1, delta[`patch`]), `applying the patch to the old response should give the full response`)
+
+	_, accepted := c.do(`/poll`, http.Header{`Accept`: {`application/json, application/json-patch+json;q=0.9`}}, oak.Json{`id`: id, `v`: 1, `base`: base})
+
+	assert.Equal(t, delta, accepted, `an Accept header listing JSON Patch should ask for a patch`)
+
+	c.post(`/act`, oak.Json{`n`: 1})
+	resp := c.post(`/poll`, oak.Json{`id`: id, `v`: 1, `base`: base, `delta`: true})
+
+	assert.Nil(t, resp[`patch`], `a poll from a response that is no longer remembered should get the full response`)
+	assert.Equal(t, float64(3), resp[`v`], `a full response should be at the current version`)
+}
+
+func Test_WithDeltaResponses_getPoll(t *testing.T){
+	router := mux.NewRouter()
+	RouteLocalTest(router, func()Entity{return &actTestEntity{}}, func(e Entity)Entity{return e}, 300, `test`, `auth`, `crypt-key-0123456789abcdefghijkl`, ``, ``, &actTestEntity{}, actTestResp, deltaTestResp, actTestPerformAct, time.Hour, WithDeltaResponses(10, 2), WithPollETags())
+	server := httptest.NewServer(router)
+	defer server.Close()
+	c := newTestClient(server)
+
+	id := c.post(`/create`, nil)[`id`].(string)
+	resp, _ := c.do(`/act`, nil, oak.Json{`n`: 1})
+	base := resp.Header.Get(`X-Delta-Base`)
+	c.post(`/act`, oak.Json{`n`: 1})
+	r, _ := http.NewRequest(`GET`, c.url + `/poll?id=` + id + `&v=1&delta=true&base=` + base, nil)
+	resp, err := c.http.Do(r)
+	respJson := oak.Json{}
+	if err == nil {
+		json.NewDecoder(resp.Body).Decode(&respJson)
+		resp.Body.Close()
+	}
+
+	assert.Equal(t, base, respJson[`base`], `a GET poll should be patched from the base in its query`)
+	assert.Equal(t, float64(2), respJson[`v`], `a GET poll should be patched to the current version`)
+}
+
+func Test_diffJson(t *testing.T){
+	var a, b interface{}
+	json.Unmarshal([]byte(`{"keep": 1, "gone": true, "a/b": [1, 2, 3], "m~": {"x": null, "y": [1]}, "list": [{"k": 1}, 2], "t": "s"}`), &a)
+	json.Unmarshal([]byte(`{"keep": 1, "new": null, "a/b": [1, 5], "m~": {"x": false, "y": [1, 2, 3]}, "list": [{"k": 2, "j": 0}], "t": [1]}`), &b)
+
+	ops := diffJson(``, a, b, []oak.Json{})
+	d, _ := json.Marshal(ops)
+	var decoded interface{}
+	json.Unmarshal(d, &decoded)
+
+	assert.Equal(t, oak.Json(b.(map[string]interface{})), applyTestPatch(t, a.(map[string]interface{}), decoded), `applying the patch should turn a into b`)
+	assert.True(t, strings.Contains(string(d), `"path":"/a~1b/1"`), `pointers should escape /`)
+	assert.True(t, strings.Contains(string(d), `"path":"/m~0/x"`), `pointers should escape ~`)
+	assert.True(t, strings.Contains(string(d), `{"op":"add","path":"/new","value":null}`), `null values should be kept`)
+}
+
+func deltaTestResp(userId string, e oak.Entity) oak.Json {
+	board := make([]interface{}, 32)
+	for i := range board {
+		board[i] = `empty`
+	}
+	board[e.(*actTestEntity).Count] = `taken`
+	return oak.Json{`count`: e.(*actTestEntity).Count, `board`: board}
+}
+
+// Applies the add, remove and replace operations of an RFC 6902 patch.
+func applyTestPatch(t *testing.T, doc oak.Json, patch interface{}) oak.Json {
+	var root interface{}
+	d, _ := json.Marshal(doc)
+	json.Unmarshal(d, &root)
+	for _, op := range patch.([]interface{}) {
+		o := op.(map[string]interface{})
+		parts := strings.Split(o[`path`].(string), `/`)[1:]
+		for i, part := range parts {
+			parts[i] = strings.Replace(strings.Replace(part, `~1`, `/`, -1), `~0`, `~`, -1)
+		}
+		root = applyTestOp(t, root, parts, o[`op`].(string), o[`value`])
+	}
+	result := oak.Json{}
+	d, _ = json.Marshal(root)
+	json.Unmarshal(d, &result)
+	return result
+}
+
+func applyTestOp(t *testing.T, node interface{}, parts []string, op string, value interface{}) interface{} {
+	if len(parts) == 0 {
+		return value
+	}
+	switch n := node.(type) {
+	case map[string]interface{}:
+		if len(parts) > 1 {
+			n[parts[0]] = applyTestOp(t, n[parts[0]], parts[1:], op, value)
+		} else if op == `remove` {
+			delete(n, parts[0])
+		} else {
+			n[parts[0]] = value
+		}
+		return n
+	case []interface{}:
+		i, _ := strconv.Atoi(parts[0])
+		if len(parts) > 1 {
+			n[i] = applyTestOp(t, n[i], parts[1:], op, value)
+			return n
+		}
+		switch op {
+		case `remove`:
+			return append(n[:i], n[i + 1:]...)
+		case `add`:
+			return append(n[:i], append([]interface{}{value}, n[i:]...)...)
+		}
+		n[i] = value
+		return n
+	}
+	t.Fatalf(`can not apply %s at %v`, op, parts)
+	return nil
+}
@@ -0,0 +1,94 @@
+package joak
+
+import(
+	`bytes`
+	`errors`
+	`strconv`
+	`strings`
+	`net/http`
+	`io/ioutil`
+	`encoding/json`
+	`github.com/0xor1/oak`
+)
+
+// Makes /poll answer with the entity version as its ETag and with 304 Not Modified rather than an empty 200 when the version is current.
+// The version may be sent as an If-None-Match header instead of v, and id and v may be sent as query parameters on a GET, so plain HTTP
+// clients and caches can poll. Responses are marked private and must be revalidated as they depend on the session.
+func WithPollETags() Option {
+	return func(c *config) {
+		c.middleware = append(c.middleware, func(env *routeEnv, path string, next http.Handler) http.Handler {
+			if path != _POLL {
+				return next
+			}
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				reqJson, err := readPollRequest(r)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				d, _ := json.Marshal(reqJson)
+				r.Body = ioutil.NopCloser(bytes.NewReader(d))
+				bw := &bufferedWriter{header: http.Header{}, status: http.StatusOK}
+				next.ServeHTTP(bw, r)
+				if bw.status != http.StatusOK {
+					bw.flush(w)
+					return
+				}
+				bw.header.Set(`Cache-Control`, `private, no-cache`)
+				bw.header.Add(`Vary`, `Cookie`)
+				if bw.body.Len() == 0 {
+					if v, ok := reqJson[_VERSION].(float64); ok {
+						bw.header.Set(`ETag`, versionTag(int(v)))
+					}
+					bw.status = http.StatusNotModified
+				} else {
+					respJson := oak.Json{}
+					if json.Unmarshal(bw.body.Bytes(), &respJson) == nil {
+						if v, ok := respJson[_VERSION].(float64); ok {
+							bw.header.Set(`ETag`, versionTag(int(v)))
+						}
+					}
+				}
+				bw.flush(w)
+			})
+		})
+	}
+}
+
+// Reads the poll request from the body, or from the query when the body is empty, taking the version from If-None-Match when there is no v.
+func readPollRequest(r *http.Request) (oak.Json, error) {
+	reqJson := oak.Json{}
+	if r.Body != nil {
+		d, _ := ioutil.ReadAll(r.Body)
+		if len(bytes.TrimSpace(d)) > 0 {
+			json.Unmarshal(d, &reqJson)
+		}
+	}
+	if len(reqJson) == 0 {
+		query := r.URL.Query()
+		if id := query.Get(_ID); id != `` {
+			reqJson[_ID] = id
+		}
+		if v := query.Get(_VERSION); v != `` {
+			version, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, errors.New(_VERSION + ` must be a number value`)
+			}
+			reqJson[_VERSION] = float64(version)
+		}
+	}
+	if _, exists := reqJson[_VERSION]; !exists {
+		if tag := strings.TrimSpace(strings.Split(r.Header.Get(`If-None-Match`), `,`)[0]); tag != `` && tag != `*` {
+			version, err := parseVersionTag(tag)
+			if err != nil {
+				return nil, errors.New(`If-None-Match must be an entity version`)
+			}
+			reqJson[_VERSION] = float64(version)
+		}
+	}
+	return reqJson, nil
+}
+
+func versionTag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
@@ -0,0 +1,62 @@
+package joak
+
+import(
+	`time`
+	`testing`
+	`net/http`
+	`net/http/httptest`
+	`github.com/0xor1/oak`
+	`github.com/gorilla/mux`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_WithPollETags(t *testing.T){
+	router := mux.NewRouter()
+	RouteLocalTest(router, func()Entity{return &actTestEntity{}}, func(e Entity)Entity{return e}, 300, `test`, `auth`, `crypt-key-0123456789abcdefghijkl`, ``, ``, &actTestEntity{}, actTestResp, actTestResp, actTestPerformAct, time.Hour, WithPollETags())
+	server := httptest.NewServer(router)
+	defer server.Close()
+	c := newTestClient(server)
+	get := func(query string, ifNoneMatch string) *http.Response {
+		r, _ := http.NewRequest(`GET`, c.url + `/poll?` + query, nil)
+		if ifNoneMatch != `` {
+			r.Header.Set(`If-None-Match`, ifNoneMatch)
+		}
+		resp, err := c.http.Do(r)
+		if err != nil {
+			return nil
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	id := c.post(`/create`, nil)[`id`].(string)
+	resp, _ := c.do(`/poll`, nil, oak.Json{`id`: id, `v`: 0})
+
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode, `polling the current version should be not modified`)
+	assert.Equal(t, `"0"`, resp.Header.Get(`ETag`), `the ETag should be the current version`)
+	assert.Equal(t, `private, no-cache`, resp.Header.Get(`Cache-Control`), `poll responses should be private and revalidated`)
+
+	resp, respJson := c.do(`/poll`, nil, oak.Json{`id`: id, `v`: -1})
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode, `polling an old version should succeed`)
+	assert.Equal(t, `"0"`, resp.Header.Get(`ETag`), `the ETag should be the version in the response`)
+	assert.Equal(t, float64(0), respJson[`v`], `the response should still include the version`)
+
+	resp = get(`id=` + id, `"0"`)
+
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode, `If-None-Match with the current version should be not modified`)
+
+	c.post(`/act`, oak.Json{`n`: 1})
+	resp = get(`id=` + id, `"0"`)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode, `If-None-Match with an old version should get the entity`)
+	assert.Equal(t, `"1"`, resp.Header.Get(`ETag`), `the ETag should be the new version`)
+
+	resp = get(`id=` + id + `&v=1`, ``)
+
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode, `the version may be sent as a query parameter`)
+
+	resp = get(`id=` + id + `&v=one`, ``)
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, `a version that is not a number should be rejected`)
+}
@@ -0,0 +1,81 @@
+package joak
+
+import(
+	`errors`
+	`strconv`
+	`encoding/json`
+	`github.com/0xor1/oak`
+)
+
+// Keeps the last size serialized versions of each entity so they can be read with ReadAtVersion and restored with Rollback.
+func WithHistory(size int) Option {
+	return func(c *config) {
+		c.historySize = size
+	}
+}
+
+func ReadAtVersion(store oak.EntityStore, entityId string, version int) (Entity, error) {
+	es, ok := store.(*entityStore)
+	if !ok {
+		return nil, errors.New(`store must be a joak entity store`)
+	}
+	if es.historySize <= 0 {
+		return nil, errors.New(`history is not enabled for this store`)
+	}
+	snapshot, err := es.readHistory(entityId, version)
+	if err != nil {
+		return nil, err
+	}
+	e := es.ef()
+	if err = json.Unmarshal(snapshot, e); err != nil {
+		return nil, err
+	}
+	if err = migrateEntity(e, es.migrations); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Writes the snapshot of version back as a new version above the current one, the returned entity is the one that was written.
+func Rollback(store oak.EntityStore, entityId string, version int) (Entity, error) {
+	e, err := ReadAtVersion(store, entityId, version)
+	if err != nil {
+		return nil, err
+	}
+	current, err := store.Read(entityId)
+	if err != nil {
+		return nil, err
+	}
+	for e.GetVersion() < current.GetVersion() {
+		e.IncrementVersion()
+	}
+	for e.GetVersion() > current.GetVersion() {
+		e.DecrementVersion()
+	}
+	if err = store.Update(entityId, e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// History is best effort, a failure to record a version does not fail the write that produced it.
+func (es *entityStore) recordHistory(entityId string, e Entity) {
+	if es.historySize <= 0 {
+		return
+	}
+	if snapshot, err := json.Marshal(e); err == nil {
+		es.putHistory(entityId, e.GetVersion(), snapshot, es.historySize)
+	}
+}
+
+type historyRecord struct{
+	Version		int
+	Snapshot	[]byte	`datastore:",noindex"`
+}
+
+type versionNotInHistoryError struct{
+	entityId	string
+	version		int
+}
+
+func (e *versionNotInHistoryError) Error() string { return `version ` + strconv.Itoa(e.version) + ` of entity with id "` + e.entityId + `" is not in history` }
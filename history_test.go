@@ -0,0 +1,54 @@
+package joak
+
+import(
+	`time`
+	`testing`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_MemoryStore_WithHistory(t *testing.T){
+	dur, _ := time.ParseDuration(`1m`)
+	ef := func()Entity{return &schemaTestEntity{}}
+	ei := func(e Entity)Entity{return e}
+	s := newMemoryStore(ef, ei, dur, newConfig([]Option{WithHistory(2)}))
+
+	id, e, _ := s.Create()
+	for lives := 1; lives <= 3; lives++ {
+		e.(*schemaTestEntity).Lives = lives
+		s.Update(id, e)
+	}
+
+	_, err := ReadAtVersion(s, id, 1)
+
+	assert.Equal(t, `version 1 of entity with id "` + id + `" is not in history`, err.Error(), `versions beyond the history size should be dropped`)
+
+	old, err := ReadAtVersion(s, id, 2)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, 2, old.GetVersion(), `version should be the requested version`)
+	assert.Equal(t, 2, old.(*schemaTestEntity).Lives, `entity should be the snapshot at the requested version`)
+
+	e, err = Rollback(s, id, 2)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, 4, e.GetVersion(), `rollback should write a new higher version`)
+
+	current, _ := s.Read(id)
+
+	assert.Equal(t, 4, current.GetVersion(), `rollback should be persisted`)
+	assert.Equal(t, 2, current.(*schemaTestEntity).Lives, `rollback should restore the old state`)
+
+	latest, err := ReadAtVersion(s, id, 4)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, 2, latest.(*schemaTestEntity).Lives, `the rollback should be recorded in history`)
+
+	s.(*entityStore).Delete(id)
+	_, err = ReadAtVersion(s, id, 4)
+
+	assert.NotNil(t, err, `history should be deleted with the entity`)
+
+	_, err = ReadAtVersion(newMemoryStore(ef, ei, dur, newConfig(nil)), id, 0)
+
+	assert.Equal(t, `history is not enabled for this store`, err.Error(), `err should have appropriate message`)
+}
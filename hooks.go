@@ -0,0 +1,43 @@
+package joak
+
+import(
+	`log`
+)
+
+// Called with the entity as it was stored.
+type Hook func(entityId string, e Entity) error
+
+// OnCreate and OnUpdate are called after successful writes, OnExpire before an expired entity is deleted and OnDelete
+// after an entity is deleted, any of them may be nil. A failing hook does not undo the change it was called for.
+type Hooks struct{
+	OnCreate	Hook
+	OnUpdate	Hook
+	OnExpire	Hook
+	OnDelete	Hook
+	// Called with the name of the failed hook, or with appendLog, putActResp or removeActResp for failures to write the
+	// action log or an idempotency key after the response is decided. Failures are logged when it is nil.
+	OnError		func(hook string, entityId string, err error)
+}
+
+func WithHooks(hooks Hooks) Option {
+	return func(c *config) {
+		c.hooks = hooks
+	}
+}
+
+func (h *Hooks) run(name string, hook Hook, entityId string, e Entity) {
+	if hook == nil || e == nil {
+		return
+	}
+	if err := hook(entityId, e); err != nil {
+		h.fail(name, entityId, err)
+	}
+}
+
+func (h *Hooks) fail(name string, entityId string, err error) {
+	if h.OnError != nil {
+		h.OnError(name, entityId, err)
+	} else {
+		log.Printf(`joak: %s hook failed for entity with id %q: %s`, name, entityId, err)
+	}
+}
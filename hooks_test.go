@@ -0,0 +1,63 @@
+package joak
+
+import(
+	`time`
+	`errors`
+	`testing`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_MemoryStore_WithHooks(t *testing.T){
+	clock := NewFakeClock(now())
+	calls := []string{}
+	versions := []int{}
+	failures := []string{}
+	record := func(name string) Hook {
+		return func(entityId string, e Entity) error {
+			calls = append(calls, name)
+			versions = append(versions, e.GetVersion())
+			return nil
+		}
+	}
+	hooks := Hooks{
+		OnCreate: record(`create`),
+		OnUpdate: func(entityId string, e Entity) error {
+			record(`update`)(entityId, e)
+			return errors.New(`leaderboard unavailable`)
+		},
+		OnExpire: record(`expire`),
+		OnDelete: record(`delete`),
+		OnError: func(hook string, entityId string, err error) {
+			failures = append(failures, hook + `: ` + err.Error())
+		},
+	}
+	s := newMemoryStore(func()Entity{return &testEntity{}}, func(e Entity)Entity{return e}, time.Hour, newConfig([]Option{WithClock(clock), WithLifetime(10 * time.Minute, 0), WithHooks(hooks)})).(*entityStore)
+
+	id, e, _ := s.Create()
+	err := s.Update(id, e)
+
+	assert.Nil(t, err, `a failing hook should not fail the write`)
+	assert.Equal(t, []string{`create`, `update`}, calls, `OnCreate and OnUpdate should be called after successful writes`)
+	assert.Equal(t, []int{0, 1}, versions, `hooks should be given the entity as it was written`)
+	assert.Equal(t, []string{`OnUpdate: leaderboard unavailable`}, failures, `failed hooks should be reported to OnError`)
+
+	stale, _ := s.Read(id)
+	stale.(*testEntity).Version = 0
+	s.Update(id, stale)
+
+	assert.Equal(t, 2, len(calls), `OnUpdate should not be called for failed writes`)
+
+	clock.Advance(10 * time.Minute)
+	_, err = s.Read(id)
+
+	assert.True(t, isNonExtantError(err), `reads past the maximum lifetime should fail as non extant`)
+	assert.Equal(t, `expire`, calls[2], `OnExpire should be called for expired entities`)
+	assert.Equal(t, 1, versions[2], `OnExpire should be given the stored entity`)
+
+	id, e, _ = s.Create()
+	s.Update(id, e)
+	s.Delete(id)
+
+	assert.Equal(t, []string{`create`, `update`, `delete`}, calls[3:], `OnDelete should be called after the entity is deleted`)
+	assert.Equal(t, 1, versions[5], `OnDelete should be given the entity as it was before it was deleted`)
+}
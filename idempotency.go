@@ -0,0 +1,92 @@
+package joak
+
+import(
+	`time`
+	`strconv`
+	`net/http`
+	`encoding/json`
+)
+
+const(
+	_IDEMPOTENCY_KEY		= `Idempotency-Key`
+	_IDEMPOTENT_REPLAYED	= `Idempotent-Replayed`
+	// how long a reservation holds a key, so one left by a process that died is taken over by a later repeat
+	_RESERVATION_LEASE		= 30 * time.Second
+)
+
+// Remembers the response to each successful /act sent with an Idempotency-Key header for remember, an /act repeating the key for the
+// same entity and user within that time gets the original response and cookies, marked with an Idempotent-Replayed header, and is not
+// performed again. The key is reserved before the act is performed, so a repeat that arrives while the first is still being handled gets
+// 409 Conflict, and released when the act fails so it may be sent again. A reservation that is neither released nor replaced by the
+// response within 30 seconds is taken over by the next repeat.
+func WithIdempotencyKeys(remember time.Duration) Option {
+	return func(c *config) {
+		c.middleware = append(c.middleware, func(env *routeEnv, path string, next http.Handler) http.Handler {
+			if path != _ACT {
+				return next
+			}
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				key := r.Header.Get(_IDEMPOTENCY_KEY)
+				userId := env.getSessionString(r, _USER_ID)
+				entityId := env.getSessionString(r, _ENTITY_ID)
+				es, ok := env.entityStoreFactory(r).(*entityStore)
+				if key == `` || userId == `` || entityId == `` || !ok {
+					next.ServeHTTP(w, r)
+					return
+				}
+				at := env.clock.Now()
+				lease := _RESERVATION_LEASE
+				if remember < lease {
+					lease = remember
+				}
+				reserved, stored, err := es.reserveActResp(entityId, userId, key, at, at.Add(lease))
+				if err != nil {
+					writeError(w, err)
+					return
+				}
+				if !reserved {
+					resp := &storedActResp{}
+					if len(stored) == 0 || json.Unmarshal(stored, resp) != nil {
+						http.Error(w, `a request with this Idempotency-Key is still in progress`, http.StatusConflict)
+						return
+					}
+					for _, cookie := range resp.SetCookie {
+						w.Header().Add(`Set-Cookie`, cookie)
+					}
+					w.Header().Set(`Content-Type`, `application/json`)
+					w.Header().Set(_IDEMPOTENT_REPLAYED, `true`)
+					w.Write(resp.Body)
+					return
+				}
+				bw := &bufferedWriter{header: http.Header{}, status: http.StatusOK}
+				next.ServeHTTP(bw, r)
+				// the act has already been applied or has failed either way, so failing to remember or release the key is only reported
+				if bw.status == http.StatusOK {
+					d, _ := json.Marshal(&storedActResp{bw.header[`Set-Cookie`], bw.body.Bytes()})
+					if err := es.putActResp(entityId, userId, key, d, at.Add(remember)); err != nil {
+						c.hooks.fail(`putActResp`, entityId, err)
+					}
+				} else if err := es.removeActResp(entityId, userId, key); err != nil {
+					c.hooks.fail(`removeActResp`, entityId, err)
+				}
+				bw.flush(w)
+			})
+		})
+	}
+}
+
+// An empty Resp marks a key that is reserved by a request still being handled.
+type actRespRecord struct{
+	Resp		[]byte		`datastore:",noindex"`
+	DeleteAfter	time.Time
+}
+
+type storedActResp struct{
+	SetCookie	[]string	`json:"setCookie,omitempty"`
+	Body		[]byte		`json:"body"`
+}
+
+// Quoting the user id keeps names unambiguous whatever the key contains.
+func actRespName(userId string, key string) string {
+	return strconv.Quote(userId) + key
+}
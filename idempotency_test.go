@@ -0,0 +1,136 @@
+package joak
+
+import(
+	`time`
+	`strings`
+	`testing`
+	`sync/atomic`
+	`net/http`
+	`net/http/httptest`
+	`github.com/0xor1/oak`
+	`github.com/gorilla/mux`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_WithIdempotencyKeys(t *testing.T){
+	clock := NewFakeClock(now())
+	router := mux.NewRouter()
+	RouteLocalTest(router, func()Entity{return &actTestEntity{}}, func(e Entity)Entity{return e}, 300, `test`, `auth`, `crypt-key-0123456789abcdefghijkl`, ``, ``, &actTestEntity{}, actTestResp, actTestResp, actTestPerformAct, time.Hour, WithClock(clock), WithIdempotencyKeys(time.Minute))
+	server := httptest.NewServer(router)
+	defer server.Close()
+	c1, c2 := newTestClient(server), newTestClient(server)
+	act := func(c *testClient, key string, n int) (oak.Json, bool) {
+		resp, respJson := c.do(`/act`, http.Header{`Idempotency-Key`: {key}}, oak.Json{`n`: n})
+		return respJson, resp != nil && resp.Header.Get(`Idempotent-Replayed`) == `true`
+	}
+
+	id := c1.post(`/create`, nil)[`id`].(string)
+	c2.post(`/join`, oak.Json{`id`: id})
+	first, replayed := act(c1, `a`, 2)
+
+	assert.Equal(t, float64(2), first[`count`], `the first act with a key should be performed`)
+	assert.False(t, replayed, `the first act with a key should not be marked as replayed`)
+
+	repeat, replayed := act(c1, `a`, 2)
+
+	assert.Equal(t, first, repeat, `a repeated key should get the original response`)
+	assert.True(t, replayed, `a repeated key should be marked as replayed`)
+
+	resp, _ := act(c1, `b`, 3)
+
+	assert.Equal(t, float64(5), resp[`count`], `a new key should be performed`)
+
+	resp, replayed = act(c2, `a`, 1)
+
+	assert.Equal(t, float64(6), resp[`count`], `keys should be remembered per user`)
+	assert.False(t, replayed, `keys should be remembered per user`)
+
+	clock.Advance(time.Minute)
+	resp, replayed = act(c1, `a`, 2)
+
+	assert.Equal(t, float64(8), resp[`count`], `keys should be forgotten after the remember duration`)
+	assert.False(t, replayed, `keys should be forgotten after the remember duration`)
+}
+
+func Test_WithIdempotencyKeys_reservation(t *testing.T){
+	started, release := make(chan bool), make(chan bool)
+	blocking := int32(1)
+	performAct := func(json oak.Json, userId string, e oak.Entity) error {
+		if atomic.CompareAndSwapInt32(&blocking, 1, 0) {
+			started <- true
+			<-release
+		}
+		return actTestPerformAct(json, userId, e)
+	}
+	router := mux.NewRouter()
+	RouteLocalTest(router, func()Entity{return &actTestEntity{}}, func(e Entity)Entity{return e}, 300, `test`, `auth`, `crypt-key-0123456789abcdefghijkl`, ``, ``, &actTestEntity{}, actTestResp, actTestResp, performAct, time.Hour, WithIdempotencyKeys(time.Minute))
+	server := httptest.NewServer(router)
+	defer server.Close()
+	c := newTestClient(server)
+	act := func(key string, n int) (*http.Response, oak.Json) {
+		return c.do(`/act`, http.Header{`Idempotency-Key`: {key}}, oak.Json{`n`: n})
+	}
+
+	c.post(`/create`, nil)
+	done := make(chan oak.Json)
+	go func() {
+		_, respJson := act(`a`, 1)
+		done <- respJson
+	}()
+	<-started
+	resp, _ := act(`a`, 1)
+	close(release)
+	first := <-done
+
+	assert.Equal(t, http.StatusConflict, resp.StatusCode, `a repeated key should get 409 while the first request is being handled`)
+	assert.Equal(t, float64(1), first[`count`], `the first request should be performed`)
+
+	resp, respJson := act(`a`, 1)
+
+	assert.Equal(t, first, respJson, `a repeated key should get the original response once it is remembered`)
+	assert.True(t, strings.HasPrefix(resp.Header.Get(`Set-Cookie`), `test=`), `a repeated key should get the original session cookie`)
+
+	resp, _ = act(`b`, -1)
+
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode, `a failed act should fail`)
+
+	_, respJson = act(`b`, 2)
+
+	assert.Equal(t, float64(3), respJson[`count`], `a key should be released when its act fails`)
+}
+
+func Test_WithIdempotencyKeys_staleReservation(t *testing.T){
+	clock := NewFakeClock(now())
+	started, release := make(chan bool), make(chan bool)
+	blocking := int32(1)
+	performAct := func(json oak.Json, userId string, e oak.Entity) error {
+		if atomic.CompareAndSwapInt32(&blocking, 1, 0) {
+			started <- true
+			<-release
+		}
+		return actTestPerformAct(json, userId, e)
+	}
+	router := mux.NewRouter()
+	routes := RouteLocalTest(router, func()Entity{return &actTestEntity{}}, func(e Entity)Entity{return e}, 300, `test`, `auth`, `crypt-key-0123456789abcdefghijkl`, ``, ``, &actTestEntity{}, actTestResp, actTestResp, performAct, time.Hour, WithClock(clock), WithIdempotencyKeys(time.Hour))
+	server := httptest.NewServer(router)
+	defer server.Close()
+	c := newTestClient(server)
+	es := routes.EntityStore(&http.Request{}).(*entityStore)
+
+	id := c.post(`/create`, nil)[`id`].(string)
+	done := make(chan bool)
+	go func() {
+		c.do(`/act`, http.Header{`Idempotency-Key`: {`a`}}, oak.Json{`n`: 1})
+		done <- true
+	}()
+	<-started
+	held, _, _ := es.reserveActResp(id, `created_by`, `a`, clock.Now(), clock.Now())
+	clock.Advance(_RESERVATION_LEASE)
+	// as a repeat would find it if the process handling the act had died
+	stale, _, _ := es.reserveActResp(id, `created_by`, `a`, clock.Now(), clock.Now())
+	close(release)
+	<-done
+
+	assert.False(t, held, `the key should be reserved while the act is handled`)
+	assert.True(t, stale, `a reservation should be taken over once its lease has run out`)
+}
@@ -4,7 +4,10 @@ import(
 	`time`
 	`sync`
 	`errors`
+	`strconv`
+	`strings`
 	`net/http`
+	`encoding/json`
 	`github.com/0xor1/oak`
 	`github.com/0xor1/sus`
 	`github.com/0xor1/gus`
@@ -13,12 +16,23 @@ import(
 	`github.com/gorilla/mux`
 	`golang.org/x/net/context`
 	`github.com/gorilla/sessions`
+	`google.golang.org/appengine`
 	`google.golang.org/appengine/datastore`
 )
 
-var(
-	kindToLastClearOutMap = map[string]time.Time{}
-	mtx sync.Mutex
+const(
+	_CREATE = `/create`
+	_JOIN 	= `/join`
+	_POLL 	= `/poll`
+	_ACT 	= `/act`
+	_LEAVE 	= `/leave`
+
+	_USER_ID	= `userId`
+	_ENTITY_ID	= `entityId`
+	_ENTITY		= `entity`
+
+	_ID			= `id`
+	_VERSION	= `v`
 )
 
 type Entity interface{
@@ -34,107 +48,1095 @@ type EntityFactory func()Entity
 
 type EntityInitializer func(e Entity) Entity
 
+type Routes struct{
+	entityStoreFactory	oak.EntityStoreFactory
+	storeForContext		func(ctx context.Context) *entityStore
+	background			*backgroundTasks
+	flushers			[]func(ctx context.Context) error
+	actRetryStats		*ActRetryStats
+}
+
+func (rs *Routes) EntityStore(r *http.Request) oak.EntityStore {
+	return rs.entityStoreFactory(r)
+}
+
+type Option func(c *config)
+
+type config struct{
+	cacheSize	int
+	cache		*entityCache
+	middleware	[]middleware
+	routes		[]extraRoute
+	cors		*Cors
+	clock		Clock
+	migrations	[]Migration
+	wrappers			[]storeWrapper
+	historySize			int
+	stickySessionKeys	[]string
+	isOpen				func(e Entity) bool
+	lobbySummary		LobbySummary
+	maxLifetime			time.Duration
+	idleTimeout			time.Duration
+	hooks				Hooks
+	background			*backgroundTasks
+	flushers			[]func(ctx context.Context) error
+	storeTimeout		time.Duration
+	actRetryStats		ActRetryStats
+	err					error
+	lastClearOuts		*lastClearOuts
+	lifetimeEnds		*lifetimeEnds
+}
+
+// Kept in the config rather than the store as gae and sql stores are made for each request.
+type lastClearOuts struct{
+	mtx		sync.Mutex
+	times	map[string]time.Time
+}
+
+type storeWrapper func(r *http.Request, es oak.EntityStore) oak.EntityStore
+
+func newConfig(opts []Option) *config {
+	c := &config{clock: realClock{}, background: &backgroundTasks{}, lastClearOuts: &lastClearOuts{times: map[string]time.Time{}}, lifetimeEnds: &lifetimeEnds{ends: map[interface{}]time.Time{}}}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.cacheSize > 0 {
+		c.cache = newEntityCache(c.cacheSize)
+	}
+	return c
+}
+
+func (c *config) initializer(ei EntityInitializer) sus.EntityInitializer {
+	return func(v sus.Version) sus.Version {
+		e := ei(v.(Entity))
+		stampSchemaVersion(e, c.migrations)
+		if ttl, ok := e.(TTLer); ok && ttl.TTL() > 0 {
+			e.SetDeleteAfter(c.clock.Now().Add(c.storedTTL(e, ttl.TTL())))
+		}
+		return e
+	}
+}
+
 func now() time.Time {
 	return time.Now().UTC()
 }
 
-func newGaeStore(kind string, ctx context.Context, ef EntityFactory, ei EntityInitializer, deleteAfter time.Duration, clearOutAfter time.Duration) (oak.EntityStore) {
+func newGaeStore(kind string, ctx context.Context, ef EntityFactory, ei EntityInitializer, deleteAfter time.Duration, clearOutAfter time.Duration, cfg *config) (oak.EntityStore) {
+	deleteAfter = cfg.slidingDeleteAfter(deleteAfter)
+	lifetimeKind := kind + `Lifetime`
+	// the clear out runs in the background so must not be cancelled when the request that started it finishes
+	sweepCtx := detachedContext{ctx}
 
-	clearOut := func() {
-		mtx.Lock()
-		if kindToLastClearOutMap[kind].IsZero() || time.Since(kindToLastClearOutMap[kind]) >= clearOutAfter {
-			kindToLastClearOutMap[kind] = now()
-			mtx.Unlock()
-			q := datastore.NewQuery(kind).Filter(`DeleteAfter <=`, now()).KeysOnly()
-			keys := []*datastore.Key{}
-			for iter := q.Run(ctx);; {
-				key, err := iter.Next(nil)
-				if err == datastore.Done {
-					break
+	// the log, history, resume and act response records are children of the entity, the lifetime, open and lobby records share
+	// its id, none of them are deleted with it
+	removeRecords := func(c context.Context, entityKeys []*datastore.Key) error {
+		keys := []*datastore.Key{}
+		for _, entityKey := range entityKeys {
+			children, err := datastore.NewQuery(``).Ancestor(entityKey).KeysOnly().GetAll(c, nil)
+			if err != nil {
+				return err
+			}
+			for _, key := range children {
+				if !key.Equal(entityKey) {
+					keys = append(keys, key)
 				}
-				if err != nil {
-					return
+			}
+			for _, indexKind := range []string{lifetimeKind, kind + `Open`, kind + `Lobby`} {
+				keys = append(keys, datastore.NewKey(c, indexKind, entityKey.StringID(), 0, nil))
+			}
+		}
+		for len(keys) > 0 {
+			n := len(keys)
+			if n > 500 {
+				n = 500
+			}
+			if err := datastore.DeleteMulti(c, keys[:n]); err != nil {
+				return err
+			}
+			keys = keys[n:]
+		}
+		return nil
+	}
+
+	// entities that can not be loaded for OnExpire are still deleted
+	expireKeys := func(keys []*datastore.Key) error {
+		if cfg.hooks.OnExpire != nil && len(keys) > 0 {
+			es := make([]Entity, len(keys))
+			for i := range es {
+				es[i] = ef()
+			}
+			err := nds.GetMulti(sweepCtx, keys, es)
+			errs, _ := err.(appengine.MultiError)
+			if err == nil || errs != nil {
+				for i, key := range keys {
+					if (errs == nil || errs[i] == nil) && migrateEntity(es[i], cfg.migrations) == nil {
+						cfg.hooks.run(`OnExpire`, cfg.hooks.OnExpire, key.StringID(), es[i])
+					}
 				}
-				keys = append(keys, key)
 			}
-			nds.DeleteMulti(ctx, keys)
-		} else {
-			mtx.Unlock()
 		}
+		if err := nds.DeleteMulti(sweepCtx, keys); err != nil {
+			return err
+		}
+		return removeRecords(sweepCtx, keys)
+	}
+
+	clearOut := newClearOut(kind, clearOutAfter, cfg, func() {
+		q := datastore.NewQuery(kind).Filter(`DeleteAfter <=`, cfg.clock.Now()).KeysOnly()
+		keys := []*datastore.Key{}
+		for iter := q.Run(sweepCtx);; {
+			key, err := iter.Next(nil)
+			if err == datastore.Done {
+				break
+			}
+			if err != nil {
+				return
+			}
+			keys = append(keys, key)
+		}
+		expireKeys(keys)
+		if cfg.maxLifetime > 0 {
+			if lifetimeKeys, err := datastore.NewQuery(lifetimeKind).Filter(`CreatedAt <=`, cfg.clock.Now().Add(-cfg.maxLifetime)).KeysOnly().GetAll(sweepCtx, nil); err == nil {
+				entityKeys := make([]*datastore.Key, 0, len(lifetimeKeys))
+				for _, key := range lifetimeKeys {
+					entityKeys = append(entityKeys, datastore.NewKey(sweepCtx, kind, key.StringID(), 0, nil))
+				}
+				expireKeys(entityKeys)
+			}
+		}
+		for _, indexKind := range []string{kind + `Open`, kind + `Lobby`, kind + `ActResp`} {
+			if indexKeys, err := datastore.NewQuery(indexKind).Filter(`DeleteAfter <=`, cfg.clock.Now()).KeysOnly().GetAll(sweepCtx, nil); err == nil {
+				datastore.DeleteMulti(sweepCtx, indexKeys)
+			}
+		}
+	})
+
+	list := func(at time.Time) (ids []string, deleteAfters []time.Time, err error) {
+		q := datastore.NewQuery(kind).Filter(`DeleteAfter >`, at).Project(`DeleteAfter`)
+		for iter := q.Run(ctx);; {
+			props := datastore.PropertyList{}
+			key, err := iter.Next(&props)
+			if err == datastore.Done {
+				break
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			ids = append(ids, key.StringID())
+			deleteAfters = append(deleteAfters, props[0].Value.(time.Time))
+		}
+		return
+	}
+
+	put := func(id string, e Entity, deleteAfter time.Time) error {
+		_, err := nds.Put(ctx, datastore.NewKey(ctx, kind, id, 0, nil), e)
+		return err
+	}
+
+	logKind := kind + `Log`
+
+	appendLog := func(entries []*ActionLogEntry) error {
+		keys := make([]*datastore.Key, 0, len(entries))
+		records := make([]*actionLogRecord, 0, len(entries))
+		for _, entry := range entries {
+			record, err := newActionLogRecord(entry)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, datastore.NewIncompleteKey(ctx, logKind, datastore.NewKey(ctx, kind, entry.EntityId, 0, nil)))
+			records = append(records, record)
+		}
+		_, err := datastore.PutMulti(ctx, keys, records)
+		return err
+	}
+
+	readLog := func(entityId string) (entries []*ActionLogEntry, err error) {
+		q := datastore.NewQuery(logKind).Ancestor(datastore.NewKey(ctx, kind, entityId, 0, nil))
+		for iter := q.Run(ctx);; {
+			record := &actionLogRecord{}
+			_, err := iter.Next(record)
+			if err == datastore.Done {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			entry, err := record.entry(entityId)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		}
+		sortActionLog(entries)
+		return
+	}
+
+	historyKind := kind + `History`
+
+	putHistory := func(entityId string, version int, snapshot []byte, size int) error {
+		parent := datastore.NewKey(ctx, kind, entityId, 0, nil)
+		if _, err := datastore.Put(ctx, datastore.NewKey(ctx, historyKind, strconv.Itoa(version), 0, parent), &historyRecord{version, snapshot}); err != nil {
+			return err
+		}
+		keys, err := datastore.NewQuery(historyKind).Ancestor(parent).KeysOnly().GetAll(ctx, nil)
+		if err != nil {
+			return err
+		}
+		trim := []*datastore.Key{}
+		for _, key := range keys {
+			if v, err := strconv.Atoi(key.StringID()); err == nil && v <= version - size {
+				trim = append(trim, key)
+			}
+		}
+		return datastore.DeleteMulti(ctx, trim)
+	}
+
+	readHistory := func(entityId string, version int) ([]byte, error) {
+		record := &historyRecord{}
+		err := datastore.Get(ctx, datastore.NewKey(ctx, historyKind, strconv.Itoa(version), 0, datastore.NewKey(ctx, kind, entityId, 0, nil)), record)
+		if err == datastore.ErrNoSuchEntity {
+			return nil, &versionNotInHistoryError{entityId, version}
+		}
+		return record.Snapshot, err
+	}
+
+	resumeKind := kind + `Resume`
+
+	resumeGeneration := func(entityId string, userId string) (int, error) {
+		record := &resumeRecord{}
+		err := datastore.Get(ctx, datastore.NewKey(ctx, resumeKind, userId, 0, datastore.NewKey(ctx, kind, entityId, 0, nil)), record)
+		if err == datastore.ErrNoSuchEntity {
+			return 0, nil
+		}
+		return record.Generation, err
 	}
 
-	return &entityStore{deleteAfter, clearOut, gus.NewGaeStore(kind, ctx, sid.Uuid, func()sus.Version{
+	claimResumeGeneration := func(entityId string, userId string, generation int) (claimed bool, err error) {
+		err = datastore.RunInTransaction(ctx, func(tc context.Context) error {
+			key := datastore.NewKey(tc, resumeKind, userId, 0, datastore.NewKey(tc, kind, entityId, 0, nil))
+			record := &resumeRecord{}
+			if err := datastore.Get(tc, key, record); err != nil && err != datastore.ErrNoSuchEntity {
+				return err
+			}
+			if claimed = record.Generation == generation; !claimed {
+				return nil
+			}
+			record.Generation++
+			_, err := datastore.Put(tc, key, record)
+			return err
+		}, nil)
+		return
+	}
+
+	openKind := kind + `Open`
+
+	setOpen := func(entityId string, open bool, deleteAfter time.Time) error {
+		key := datastore.NewKey(ctx, openKind, entityId, 0, nil)
+		if !open {
+			if err := datastore.Delete(ctx, key); err != datastore.ErrNoSuchEntity {
+				return err
+			}
+			return nil
+		}
+		_, err := datastore.Put(ctx, key, &openRecord{deleteAfter})
+		return err
+	}
+
+	listOpen := func(at time.Time) (ids []string, err error) {
+		keys, err := datastore.NewQuery(openKind).Filter(`DeleteAfter >`, at).KeysOnly().GetAll(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			ids = append(ids, key.StringID())
+		}
+		return
+	}
+
+	lobbyKind := kind + `Lobby`
+
+	putLobby := func(entry *LobbyEntry, deleteAfter time.Time) error {
+		summary, err := json.Marshal(entry.Summary)
+		if err != nil {
+			return err
+		}
+		key := datastore.NewKey(ctx, lobbyKind, entry.Id, 0, nil)
+		record := &lobbyRecord{}
+		if err = datastore.Get(ctx, key, record); err == datastore.ErrNoSuchEntity {
+			record.CreatedAt = entry.CreatedAt
+		} else if err != nil {
+			return err
+		}
+		record.CreatedBy, record.Players, record.Summary, record.DeleteAfter = entry.CreatedBy, entry.Players, summary, deleteAfter
+		_, err = datastore.Put(ctx, key, record)
+		return err
+	}
+
+	removeLobby := func(entityId string) error {
+		if err := datastore.Delete(ctx, datastore.NewKey(ctx, lobbyKind, entityId, 0, nil)); err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		return nil
+	}
+
+	// datastore only allows one inequality filter so DeleteAfter is checked here rather than in the query
+	listLobby := func(at time.Time, after lobbyCursor, limit int) (entries []*LobbyEntry, err error) {
+		q := datastore.NewQuery(lobbyKind).Filter(`CreatedAt >=`, after.createdAt).Order(`CreatedAt`)
+		for iter := q.Run(ctx); len(entries) < limit; {
+			record := &lobbyRecord{}
+			key, err := iter.Next(record)
+			if err == datastore.Done {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if !after.before(record.CreatedAt, key.StringID()) || !record.DeleteAfter.After(at) {
+				continue
+			}
+			entry, err := record.entry(key.StringID())
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		}
+		return
+	}
+
+	putLifetime := func(entityId string, r *lifetimeRecord) error {
+		_, err := datastore.Put(ctx, datastore.NewKey(ctx, lifetimeKind, entityId, 0, nil), r)
+		return err
+	}
+
+	readLifetime := func(entityId string) (*lifetimeRecord, error) {
+		r := &lifetimeRecord{}
+		err := datastore.Get(ctx, datastore.NewKey(ctx, lifetimeKind, entityId, 0, nil), r)
+		if err == datastore.ErrNoSuchEntity {
+			return nil, nil
+		}
+		return r, err
+	}
+
+	actRespKind := kind + `ActResp`
+
+	putActResp := func(entityId string, userId string, key string, resp []byte, deleteAfter time.Time) error {
+		_, err := datastore.Put(ctx, datastore.NewKey(ctx, actRespKind, actRespName(userId, key), 0, datastore.NewKey(ctx, kind, entityId, 0, nil)), &actRespRecord{resp, deleteAfter})
+		return err
+	}
+
+	reserveActResp := func(entityId string, userId string, key string, at time.Time, deleteAfter time.Time) (reserved bool, resp []byte, err error) {
+		err = datastore.RunInTransaction(ctx, func(tc context.Context) error {
+			recordKey := datastore.NewKey(tc, actRespKind, actRespName(userId, key), 0, datastore.NewKey(tc, kind, entityId, 0, nil))
+			record := &actRespRecord{}
+			err := datastore.Get(tc, recordKey, record)
+			if err != nil && err != datastore.ErrNoSuchEntity {
+				return err
+			}
+			if err == nil && record.DeleteAfter.After(at) {
+				reserved, resp = false, record.Resp
+				return nil
+			}
+			reserved, resp = true, nil
+			_, err = datastore.Put(tc, recordKey, &actRespRecord{nil, deleteAfter})
+			return err
+		}, nil)
+		return
+	}
+
+	removeActResp := func(entityId string, userId string, key string) error {
+		return datastore.Delete(ctx, datastore.NewKey(ctx, actRespKind, actRespName(userId, key), 0, datastore.NewKey(ctx, kind, entityId, 0, nil)))
+	}
+
+	b := &backend{
+		list: list,
+		put: put,
+		appendLog: appendLog,
+		readLog: readLog,
+		putHistory: putHistory,
+		readHistory: readHistory,
+		resumeGeneration: resumeGeneration,
+		claimResumeGeneration: claimResumeGeneration,
+		setOpen: setOpen,
+		listOpen: listOpen,
+		putLobby: putLobby,
+		removeLobby: removeLobby,
+		listLobby: listLobby,
+		putLifetime: putLifetime,
+		readLifetime: readLifetime,
+		putActResp: putActResp,
+		reserveActResp: reserveActResp,
+		removeActResp: removeActResp,
+	}
+
+	inner := gus.NewGaeStore(kind, ctx, sid.Uuid, func()sus.Version{
 		e := ef()
-		e.SetDeleteAfter(now().Add(deleteAfter))
+		e.SetDeleteAfter(cfg.clock.Now().Add(cfg.storedTTL(e, deleteAfter)))
 		return e
-	}, func(v sus.Version)sus.Version{
-		return ei(v.(Entity))
-	})}
+	}, cfg.initializer(ei))
+
+	es := newEntityStore(ef, deleteAfter, clearOut, b, &gaeStore{inner, func(ids []string) error {
+		keys := make([]*datastore.Key, 0, len(ids))
+		for _, id := range ids {
+			keys = append(keys, datastore.NewKey(ctx, kind, id, 0, nil))
+		}
+		return removeRecords(ctx, keys)
+	}}, cfg)
+	// the datastore has no read of the version cheaper than reading the entity, which nds already caches in memcache
+	es.cache = nil
+	return es.withContext(ctx)
 }
 
-func newMemoryStore(ef EntityFactory, ei EntityInitializer, deleteAfter time.Duration) oak.EntityStore {
-	return &entityStore{deleteAfter, func(){}, sus.NewJsonMemoryStore(sid.Uuid, func()sus.Version{return ef()}, func(v sus.Version)sus.Version{return ei(v.(Entity))})}
+// Deletes the records kept beside an entity when it is deleted, as the memory and SQL stores do.
+type gaeStore struct{
+	sus.Store
+	removeRecords	func(ids []string) error
+}
+
+func (s *gaeStore) Delete(id string) error {
+	return s.DeleteMulti([]string{id})
+}
+
+func (s *gaeStore) DeleteMulti(ids []string) error {
+	if err := s.Store.DeleteMulti(ids); err != nil {
+		return err
+	}
+	return s.removeRecords(ids)
+}
+
+func newClearOut(kind string, clearOutAfter time.Duration, cfg *config, sweep func()) func() {
+	last := cfg.lastClearOuts
+	return func() {
+		last.mtx.Lock()
+		at := cfg.clock.Now()
+		if last.times[kind].IsZero() || at.Sub(last.times[kind]) >= clearOutAfter {
+			last.times[kind] = at
+			last.mtx.Unlock()
+			sweep()
+			if cfg.cache != nil {
+				cfg.cache.removeExpired(cfg.clock.Now())
+			}
+		} else {
+			last.mtx.Unlock()
+		}
+	}
+}
+
+func newMemoryStore(ef EntityFactory, ei EntityInitializer, deleteAfter time.Duration, cfg *config) oak.EntityStore {
+	deleteAfter = cfg.slidingDeleteAfter(deleteAfter)
+	entries := map[string]*memoryEntry{}
+	logs := map[string][]*ActionLogEntry{}
+	history := map[string][]*historyRecord{}
+	resumeGenerations := map[string]map[string]int{}
+	open := map[string]bool{}
+	lobby := map[string]*LobbyEntry{}
+	lifetimes := map[string]lifetimeRecord{}
+	actResps := map[string]map[string]*actRespRecord{}
+	entriesMtx := sync.RWMutex{}
+
+	get := func(id string) ([]byte, error) {
+		entriesMtx.RLock()
+		defer entriesMtx.RUnlock()
+		me, exists := entries[id]
+		if !exists {
+			return nil, &entityDoesNotExistError{id}
+		}
+		return me.data, nil
+	}
+
+	set := func(id string, d []byte, deleteAfter time.Time) error {
+		entriesMtx.Lock()
+		defer entriesMtx.Unlock()
+		entries[id] = &memoryEntry{d, deleteAfter}
+		return nil
+	}
+
+	del := func(id string) error {
+		entriesMtx.Lock()
+		defer entriesMtx.Unlock()
+		delete(entries, id)
+		delete(logs, id)
+		delete(history, id)
+		delete(resumeGenerations, id)
+		delete(open, id)
+		delete(lobby, id)
+		delete(lifetimes, id)
+		delete(actResps, id)
+		return nil
+	}
+
+	list := func(at time.Time) (ids []string, deleteAfters []time.Time, err error) {
+		entriesMtx.RLock()
+		defer entriesMtx.RUnlock()
+		for id, me := range entries {
+			if me.deleteAfter.After(at) {
+				ids = append(ids, id)
+				deleteAfters = append(deleteAfters, me.deleteAfter)
+			}
+		}
+		return
+	}
+
+	put := func(id string, e Entity, deleteAfter time.Time) error {
+		d, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		return set(id, d, deleteAfter)
+	}
+
+	appendLog := func(newEntries []*ActionLogEntry) error {
+		entriesMtx.Lock()
+		defer entriesMtx.Unlock()
+		for _, entry := range newEntries {
+			logs[entry.EntityId] = append(logs[entry.EntityId], entry)
+		}
+		return nil
+	}
+
+	readLog := func(entityId string) ([]*ActionLogEntry, error) {
+		entriesMtx.RLock()
+		defer entriesMtx.RUnlock()
+		entries := append([]*ActionLogEntry{}, logs[entityId]...)
+		sortActionLog(entries)
+		return entries, nil
+	}
+
+	putHistory := func(entityId string, version int, snapshot []byte, size int) error {
+		entriesMtx.Lock()
+		defer entriesMtx.Unlock()
+		records := []*historyRecord{}
+		for _, record := range history[entityId] {
+			if record.Version > version - size && record.Version != version {
+				records = append(records, record)
+			}
+		}
+		history[entityId] = append(records, &historyRecord{version, snapshot})
+		return nil
+	}
+
+	readHistory := func(entityId string, version int) ([]byte, error) {
+		entriesMtx.RLock()
+		defer entriesMtx.RUnlock()
+		for _, record := range history[entityId] {
+			if record.Version == version {
+				return record.Snapshot, nil
+			}
+		}
+		return nil, &versionNotInHistoryError{entityId, version}
+	}
+
+	resumeGeneration := func(entityId string, userId string) (int, error) {
+		entriesMtx.RLock()
+		defer entriesMtx.RUnlock()
+		return resumeGenerations[entityId][userId], nil
+	}
+
+	claimResumeGeneration := func(entityId string, userId string, generation int) (bool, error) {
+		entriesMtx.Lock()
+		defer entriesMtx.Unlock()
+		if resumeGenerations[entityId][userId] != generation {
+			return false, nil
+		}
+		if resumeGenerations[entityId] == nil {
+			resumeGenerations[entityId] = map[string]int{}
+		}
+		resumeGenerations[entityId][userId]++
+		return true, nil
+	}
+
+	setOpen := func(entityId string, isOpen bool, deleteAfter time.Time) error {
+		entriesMtx.Lock()
+		defer entriesMtx.Unlock()
+		if isOpen {
+			open[entityId] = true
+		} else {
+			delete(open, entityId)
+		}
+		return nil
+	}
+
+	listOpen := func(at time.Time) (ids []string, err error) {
+		entriesMtx.RLock()
+		defer entriesMtx.RUnlock()
+		for id := range open {
+			if me, exists := entries[id]; exists && me.deleteAfter.After(at) {
+				ids = append(ids, id)
+			}
+		}
+		return
+	}
+
+	putLobby := func(entry *LobbyEntry, deleteAfter time.Time) error {
+		entriesMtx.Lock()
+		defer entriesMtx.Unlock()
+		if existing, exists := lobby[entry.Id]; exists {
+			entry.CreatedAt = existing.CreatedAt
+		}
+		lobby[entry.Id] = entry
+		return nil
+	}
+
+	removeLobby := func(entityId string) error {
+		entriesMtx.Lock()
+		defer entriesMtx.Unlock()
+		delete(lobby, entityId)
+		return nil
+	}
+
+	listLobby := func(at time.Time, after lobbyCursor, limit int) ([]*LobbyEntry, error) {
+		entriesMtx.RLock()
+		defer entriesMtx.RUnlock()
+		live := []*LobbyEntry{}
+		for id, entry := range lobby {
+			if me, exists := entries[id]; exists && me.deleteAfter.After(at) && after.before(entry.CreatedAt, id) {
+				live = append(live, entry)
+			}
+		}
+		sortLobby(live)
+		if len(live) > limit {
+			live = live[:limit]
+		}
+		return live, nil
+	}
+
+	putLifetime := func(entityId string, r *lifetimeRecord) error {
+		entriesMtx.Lock()
+		defer entriesMtx.Unlock()
+		lifetimes[entityId] = *r
+		return nil
+	}
+
+	readLifetime := func(entityId string) (*lifetimeRecord, error) {
+		entriesMtx.RLock()
+		defer entriesMtx.RUnlock()
+		if r, exists := lifetimes[entityId]; exists {
+			return &r, nil
+		}
+		return nil, nil
+	}
+
+	putActResp := func(entityId string, userId string, key string, resp []byte, deleteAfter time.Time) error {
+		entriesMtx.Lock()
+		defer entriesMtx.Unlock()
+		if actResps[entityId] == nil {
+			actResps[entityId] = map[string]*actRespRecord{}
+		}
+		for k, record := range actResps[entityId] {
+			if !record.DeleteAfter.After(cfg.clock.Now()) {
+				delete(actResps[entityId], k)
+			}
+		}
+		actResps[entityId][actRespName(userId, key)] = &actRespRecord{resp, deleteAfter}
+		return nil
+	}
+
+	reserveActResp := func(entityId string, userId string, key string, at time.Time, deleteAfter time.Time) (bool, []byte, error) {
+		entriesMtx.Lock()
+		defer entriesMtx.Unlock()
+		if record, exists := actResps[entityId][actRespName(userId, key)]; exists && record.DeleteAfter.After(at) {
+			return false, record.Resp, nil
+		}
+		if actResps[entityId] == nil {
+			actResps[entityId] = map[string]*actRespRecord{}
+		}
+		actResps[entityId][actRespName(userId, key)] = &actRespRecord{nil, deleteAfter}
+		return true, nil, nil
+	}
+
+	removeActResp := func(entityId string, userId string, key string) error {
+		entriesMtx.Lock()
+		defer entriesMtx.Unlock()
+		delete(actResps[entityId], actRespName(userId, key))
+		return nil
+	}
+
+	isNonExtantError := func(err error) bool {
+		_, ok := err.(*entityDoesNotExistError)
+		return ok
+	}
+
+	// the byte store always puts straight after marshalling inside its transaction lock, so the ttl of the entity being put can be passed along
+	var putTTL time.Duration
+	inner := sus.NewMutexByteStore(get, func(id string, d []byte) error {
+		return set(id, d, cfg.clock.Now().Add(putTTL))
+	}, del, func(v sus.Version)([]byte, error){
+		putTTL = cfg.storedTTL(v, deleteAfter)
+		return json.Marshal(v)
+	}, func(d []byte, v sus.Version) error {
+		return json.Unmarshal(d, v)
+	}, sid.Uuid, func()sus.Version{return ef()}, cfg.initializer(ei), isNonExtantError)
+
+	b := &backend{
+		list: list,
+		put: put,
+		appendLog: appendLog,
+		readLog: readLog,
+		putHistory: putHistory,
+		readHistory: readHistory,
+		resumeGeneration: resumeGeneration,
+		claimResumeGeneration: claimResumeGeneration,
+		setOpen: setOpen,
+		listOpen: listOpen,
+		putLobby: putLobby,
+		removeLobby: removeLobby,
+		listLobby: listLobby,
+		putLifetime: putLifetime,
+		readLifetime: readLifetime,
+		putActResp: putActResp,
+		reserveActResp: reserveActResp,
+		removeActResp: removeActResp,
+	}
+
+	return newEntityStore(ef, deleteAfter, func(){}, b, inner, cfg)
+}
+
+type memoryEntry struct{
+	data		[]byte
+	deleteAfter	time.Time
+}
+
+type backend struct{
+	list			func(at time.Time) (ids []string, deleteAfters []time.Time, err error)
+	put				func(id string, e Entity, deleteAfter time.Time) error
+	appendLog		func(entries []*ActionLogEntry) error
+	readLog			func(entityId string) ([]*ActionLogEntry, error)
+	putHistory				func(entityId string, version int, snapshot []byte, size int) error
+	readHistory				func(entityId string, version int) ([]byte, error)
+	resumeGeneration		func(entityId string, userId string) (int, error)
+	claimResumeGeneration	func(entityId string, userId string, generation int) (bool, error)
+	setOpen					func(entityId string, open bool, deleteAfter time.Time) error
+	listOpen				func(at time.Time) ([]string, error)
+	putLobby				func(entry *LobbyEntry, deleteAfter time.Time) error
+	removeLobby				func(entityId string) error
+	listLobby				func(at time.Time, after lobbyCursor, limit int) ([]*LobbyEntry, error)
+	putLifetime				func(entityId string, r *lifetimeRecord) error
+	readLifetime			func(entityId string) (*lifetimeRecord, error)
+	putActResp				func(entityId string, userId string, key string, resp []byte, deleteAfter time.Time) error
+	reserveActResp			func(entityId string, userId string, key string, at time.Time, deleteAfter time.Time) (reserved bool, resp []byte, err error)
+	removeActResp			func(entityId string, userId string, key string) error
+	readVersion				func(entityId string) (int, error)
+}
+
+func newEntityStore(ef EntityFactory, deleteAfter time.Duration, clearOut func(), b *backend, inner sus.Store, cfg *config) *entityStore {
+	return &entityStore{
+		backend: b,
+		ef: ef,
+		deleteAfter: deleteAfter,
+		clearOut: clearOut,
+		inner: inner,
+		cache: cfg.cache,
+		clock: cfg.clock,
+		migrations: cfg.migrations,
+		historySize: cfg.historySize,
+		isOpen: cfg.isOpen,
+		lobbySummary: cfg.lobbySummary,
+		maxLifetime: cfg.maxLifetime,
+		trackLifetime: cfg.maxLifetime > 0 || cfg.idleTimeout > 0,
+		lifetimeEnds: cfg.lifetimeEnds,
+		storedTTL: cfg.storedTTL,
+		hooks: cfg.hooks,
+		background: cfg.background,
+		ctx: context.Background(),
+	}
 }
 
 type entityStore struct {
+	*backend
+	ef			EntityFactory
 	deleteAfter time.Duration
 	clearOut  	func()
 	inner 		sus.Store
+	cache		*entityCache
+	clock		Clock
+	migrations	[]Migration
+	historySize	int
+	isOpen		func(e Entity) bool
+	lobbySummary	LobbySummary
+	maxLifetime	time.Duration
+	trackLifetime	bool
+	lifetimeEnds	*lifetimeEnds
+	storedTTL		func(v interface{}, deleteAfter time.Duration) time.Duration
+	hooks			Hooks
+	background		*backgroundTasks
+	ctx				context.Context
 }
 
 func (es *entityStore) Create() (string, oak.Entity, error) {
-	go es.clearOut()
+	if err := es.ctx.Err(); err != nil {
+		return ``, nil, err
+	}
+	es.background.start(es.clearOut)
 	id, v, err := es.inner.Create()
 	var e Entity
 	if err == nil && v != nil {
 		e = v.(Entity)
+		var r *lifetimeRecord
+		if es.trackLifetime {
+			r = &lifetimeRecord{CreatedAt: es.clock.Now()}
+			r.IdleUntil = es.expiresAt(e, es.lifetimeEnd(r))
+			if err = es.putLifetime(id, r); err != nil {
+				return id, e, err
+			}
+		}
+		es.cacheSet(id, e, es.lifetimeEnd(r))
+		es.recordHistory(id, e)
+		es.indexOpen(id, e)
+		es.indexLobby(id, e)
+		es.hooks.run(`OnCreate`, es.hooks.OnCreate, id, e)
 	}
 	return id, e, err
 }
 
 func (es *entityStore) Read(entityId string) (oak.Entity, error) {
-	go es.clearOut()
+	if err := es.ctx.Err(); err != nil {
+		return nil, err
+	}
+	es.background.start(es.clearOut)
+	if es.cache != nil {
+		if e := es.cache.get(entityId, es.clock.Now()); e != nil && es.cacheCurrent(entityId, e) {
+			if c, ok := cloneEntity(e); ok {
+				return c, nil
+			}
+		}
+	}
 	v, err := es.inner.Read(entityId)
 	var e Entity
 	if err == nil && v != nil {
 		e = v.(Entity)
+		if err = migrateEntity(e, es.migrations); err != nil {
+			return nil, err
+		}
+		r, err := es.lifetime(entityId)
+		if err != nil {
+			return nil, err
+		}
+		if es.expired(r) {
+			return nil, es.expire(entityId, e)
+		}
+		es.cacheSet(entityId, e, es.lifetimeEnd(r))
 	}
 	return e, err
 }
 
 func (es *entityStore) Update(entityId string, entity oak.Entity) (error) {
-	go es.clearOut()
+	if err := es.ctx.Err(); err != nil {
+		return err
+	}
+	es.background.start(es.clearOut)
+	r, err := es.lifetime(entityId)
+	if err != nil {
+		return err
+	}
+	if es.expired(r) {
+		var stored Entity
+		if v, err := es.inner.Read(entityId); err == nil {
+			stored = v.(Entity)
+		}
+		return es.expire(entityId, stored)
+	}
+	end := es.lifetimeEnd(r)
 	e, ok := entity.(Entity)
+	if ok && !end.IsZero() {
+		es.lifetimeEnds.set(e, end)
+		defer es.lifetimeEnds.remove(e)
+	}
 	if ok {
-		e.SetDeleteAfter(now().Add(es.deleteAfter))
+		e.SetDeleteAfter(es.expiresAt(e, end))
+		stampSchemaVersion(e, es.migrations)
+		// extending the idle deadline before the write is harmless if the write then fails
+		if r != nil {
+			r.IdleUntil = es.expiresAt(e, end)
+			if err = es.putLifetime(entityId, r); err != nil {
+				return err
+			}
+		}
 	}
-	return es.inner.Update(entityId, e)
+	err = es.inner.Update(entityId, e)
+	if err == nil {
+		es.cacheSet(entityId, e, end)
+		es.recordHistory(entityId, e)
+		es.indexOpen(entityId, e)
+		es.indexLobby(entityId, e)
+		es.hooks.run(`OnUpdate`, es.hooks.OnUpdate, entityId, e)
+	} else if es.cache != nil {
+		es.cache.remove(entityId)
+	}
+	return err
+}
+
+func (es *entityStore) Delete(entityId string) error {
+	if err := es.ctx.Err(); err != nil {
+		return err
+	}
+	var e Entity
+	if es.hooks.OnDelete != nil {
+		if v, err := es.inner.Read(entityId); err == nil {
+			e = v.(Entity)
+		}
+	}
+	if err := es.remove(entityId); err != nil {
+		return err
+	}
+	es.hooks.run(`OnDelete`, es.hooks.OnDelete, entityId, e)
+	return nil
 }
 
-func RouteLocalTest(router *mux.Router, ef EntityFactory, ei EntityInitializer, sessionMaxAge int, sessionName string, newAuthKey string, newCryptKey string, oldAuthKey string, oldCryptKey string, entity Entity, getJoinResp oak.GetJoinResp, getEntityChangeResp oak.GetEntityChangeResp, performAct oak.PerformAct, deleteAfter time.Duration){
+func (es *entityStore) remove(entityId string) error {
+	if es.cache != nil {
+		es.cache.remove(entityId)
+	}
+	return es.inner.Delete(entityId)
+}
+
+// other processes may have updated the entity, when the backend can read its version without the entity the cached copy is checked against it
+func (es *entityStore) cacheCurrent(entityId string, e Entity) bool {
+	if es.readVersion == nil {
+		return true
+	}
+	if version, err := es.readVersion(entityId); err == nil && version == e.GetVersion() {
+		return true
+	}
+	es.cache.remove(entityId)
+	return false
+}
+
+func (es *entityStore) cacheSet(entityId string, e Entity, end time.Time) {
+	if es.cache == nil {
+		return
+	}
+	if c, ok := cloneEntity(e); ok {
+		es.cache.set(entityId, c, es.expiresAt(e, end))
+	} else {
+		es.cache.remove(entityId)
+	}
+}
+
+// Panics when an option is invalid, as there is no error to return.
+func RouteLocalTest(router *mux.Router, ef EntityFactory, ei EntityInitializer, sessionMaxAge int, sessionName string, newAuthKey string, newCryptKey string, oldAuthKey string, oldCryptKey string, entity Entity, getJoinResp oak.GetJoinResp, getEntityChangeResp oak.GetEntityChangeResp, performAct oak.PerformAct, deleteAfter time.Duration, opts ...Option) *Routes {
+	cfg := newConfig(opts)
+	cfg.requireCloner(entity)
+	if cfg.err != nil {
+		panic(cfg.err)
+	}
 	sessionStore := initCookieSessionStore(sessionMaxAge, newAuthKey, newCryptKey, oldAuthKey, oldCryptKey)
-	memStore := newMemoryStore(ef, ei, deleteAfter)
-	oak.Route(router, sessionStore, sessionName, entity, func(r *http.Request)oak.EntityStore{return memStore}, getJoinResp, getEntityChangeResp, performAct)
+	memStore := newMemoryStore(ef, ei, deleteAfter, cfg).(*entityStore)
+	storeForContext := func(ctx context.Context) *entityStore {return memStore.withContext(ctx)}
+	return route(router, sessionStore, sessionName, []byte(newAuthKey), entity, storeForContext, requestContext, getJoinResp, getEntityChangeResp, performAct, cfg)
+}
+
+func RouteGaeProd(router *mux.Router, ef EntityFactory, ei EntityInitializer, sessionMaxAge int, sessionName string, newAuthKey string, newCryptKey string, oldAuthKey string, oldCryptKey string, entity Entity, getJoinResp oak.GetJoinResp, getEntityChangeResp oak.GetEntityChangeResp, performAct oak.PerformAct, deleteAfter time.Duration, clearOutAfter time.Duration, kind string, ctxFactory ContextFactory, opts ...Option) error {
+	_, err := RouteGaeProdRoutes(router, ef, ei, sessionMaxAge, sessionName, newAuthKey, newCryptKey, oldAuthKey, oldCryptKey, entity, getJoinResp, getEntityChangeResp, performAct, deleteAfter, clearOutAfter, kind, ctxFactory, opts...)
+	return err
 }
 
-func RouteGaeProd(router *mux.Router, ef EntityFactory, ei EntityInitializer, sessionMaxAge int, sessionName string, newAuthKey string, newCryptKey string, oldAuthKey string, oldCryptKey string, entity Entity, getJoinResp oak.GetJoinResp, getEntityChangeResp oak.GetEntityChangeResp, performAct oak.PerformAct, deleteAfter time.Duration, clearOutAfter time.Duration, kind string, ctxFactory ContextFactory) error {
+// Same as RouteGaeProd but also returns the Routes, for access to the entity store for Export and Import, and to Shutdown.
+func RouteGaeProdRoutes(router *mux.Router, ef EntityFactory, ei EntityInitializer, sessionMaxAge int, sessionName string, newAuthKey string, newCryptKey string, oldAuthKey string, oldCryptKey string, entity Entity, getJoinResp oak.GetJoinResp, getEntityChangeResp oak.GetEntityChangeResp, performAct oak.PerformAct, deleteAfter time.Duration, clearOutAfter time.Duration, kind string, ctxFactory ContextFactory, opts ...Option) (*Routes, error) {
 	if kind == `` {
-		return errors.New(`kind must not be an empty string`)
+		return nil, errors.New(`kind must not be an empty string`)
 	}
 	if deleteAfter.Seconds() <= 0 {
-		return errors.New(`deleteAfter must be a positive time.Duration`)
+		return nil, errors.New(`deleteAfter must be a positive time.Duration`)
 	}
 	if clearOutAfter.Seconds() <= 0 {
-		return errors.New(`clearOutAfter must be a positive time.Duration`)
+		return nil, errors.New(`clearOutAfter must be a positive time.Duration`)
 	}
 
+	cfg := newConfig(opts)
+	if cfg.err != nil {
+		return nil, cfg.err
+	}
 	sessionStore := initCookieSessionStore(sessionMaxAge, newAuthKey, newCryptKey, oldAuthKey, oldCryptKey)
-	entityStoreFactory := func(r *http.Request)oak.EntityStore{
-		ctx := ctxFactory(r)
-		return newGaeStore(kind, ctx, ef, ei, deleteAfter, clearOutAfter)
+	storeForContext := func(ctx context.Context) *entityStore {
+		return newGaeStore(kind, ctx, ef, ei, deleteAfter, clearOutAfter, cfg).(*entityStore)
 	}
-	oak.Route(router, sessionStore, sessionName, entity, entityStoreFactory, getJoinResp, getEntityChangeResp, performAct)
-	return nil
+	return route(router, sessionStore, sessionName, []byte(newAuthKey), entity, storeForContext, ctxFactory, getJoinResp, getEntityChangeResp, performAct, cfg), nil
+}
+
+func route(router *mux.Router, sessionStore sessions.Store, sessionName string, authKey []byte, entity Entity, storeForContext func(ctx context.Context) *entityStore, contextFactory ContextFactory, getJoinResp oak.GetJoinResp, getEntityChangeResp oak.GetEntityChangeResp, performAct oak.PerformAct, cfg *config) *Routes {
+	inner := mux.NewRouter()
+	inner.KeepContext = true
+	entityStoreFactory := func(r *http.Request) oak.EntityStore {
+		return storeForContext(storeContext(r, contextFactory))
+	}
+	if len(cfg.stickySessionKeys) > 0 {
+		sessionStore = &stickySessionStore{sessionStore, cfg.stickySessionKeys}
+	}
+	env := &routeEnv{sessionStore, sessionName, authKey, entityStoreFactory, cfg.wrappers, getJoinResp, getEntityChangeResp, cfg.clock}
+	oak.Route(inner, sessionStore, sessionName, entity, func(r *http.Request) oak.EntityStore {
+		return env.wrapStore(r, entityStoreFactory(r))
+	}, getJoinResp, getEntityChangeResp, performAct)
+	wrap := func(path string, h http.Handler) http.Handler {
+		for i := len(cfg.middleware) - 1; i >= 0; i-- {
+			h = cfg.middleware[i](env, path, h)
+		}
+		h = requestContextHandler(contextFactory, cfg.storeTimeout, h)
+		if cfg.cors != nil {
+			h = cfg.cors.handler(h)
+		}
+		return h
+	}
+	for _, path := range []string{_CREATE, _JOIN, _POLL, _ACT, _LEAVE} {
+		router.Path(path).Handler(wrap(path, inner))
+	}
+	for _, er := range cfg.routes {
+		router.Path(er.path).Handler(wrap(er.path, er.handler(env)))
+	}
+	return &Routes{entityStoreFactory, storeForContext, cfg.background, cfg.flushers, &cfg.actRetryStats}
+}
+
+type middleware func(env *routeEnv, path string, next http.Handler) http.Handler
+
+type extraRoute struct{
+	path	string
+	handler	func(env *routeEnv) http.Handler
+}
+
+type routeEnv struct{
+	sessionStore		sessions.Store
+	sessionName			string
+	authKey				[]byte
+	entityStoreFactory	oak.EntityStoreFactory
+	wrappers			[]storeWrapper
+	getJoinResp			oak.GetJoinResp
+	getEntityChangeResp	oak.GetEntityChangeResp
+	clock				Clock
+}
+
+// Applies the store wrappers, extra routes that change entities the way oak's routes do should write through the wrapped store.
+func (env *routeEnv) wrapStore(r *http.Request, es oak.EntityStore) oak.EntityStore {
+	for _, wrap := range env.wrappers {
+		es = wrap(r, es)
+	}
+	return es
+}
+
+func (env *routeEnv) getSessionString(r *http.Request, key string) string {
+	s, err := env.sessionStore.Get(r, env.sessionName)
+	if err != nil || s == nil {
+		return ``
+	}
+	str, _ := s.Values[key].(string)
+	return str
+}
+
+func (env *routeEnv) getSessionEntity(r *http.Request) Entity {
+	s, err := env.sessionStore.Get(r, env.sessionName)
+	if err != nil || s == nil {
+		return nil
+	}
+	e, _ := s.Values[_ENTITY].(Entity)
+	return e
+}
+
+func writeJson(w http.ResponseWriter, obj interface{}) error {
+	js, err := json.Marshal(obj)
+	w.Header().Set(`Content-Type`, `application/json`)
+	w.Write(js)
+	return err
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	http.Error(w, err.Error(), 500)
 }
 
 func initCookieSessionStore(sessionMaxAge int, newAuthKey string, newCryptKey string, oldAuthKey string, oldCryptKey string) sessions.Store {
@@ -142,4 +1144,25 @@ func initCookieSessionStore(sessionMaxAge int, newAuthKey string, newCryptKey st
 	ss.Options.HttpOnly = true
 	ss.Options.MaxAge = sessionMaxAge
 	return ss
-}
\ No newline at end of file
+}
+type entityDoesNotExistError struct{
+	id string
+}
+
+func (e *entityDoesNotExistError) Error() string { return `entity with id "` + e.id + `" does not exist` }
+
+func isNonExtantError(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), `Non extant error`)
+}
+
+type nonExtantError struct{
+	inner error
+}
+
+func (e *nonExtantError) Error() string { return `Non extant error, inner error message: ` + e.inner.Error() }
+
+type nonsequentialUpdateError struct{
+	id string
+}
+
+func (e *nonsequentialUpdateError) Error() string { return `nonsequential update for entity with id "` + e.id + `"` }
@@ -67,7 +67,7 @@ func Test_RouteGaeProd_EntityStoreFactory(t *testing.T){
 func Test_MemoryStore(t *testing.T){
 	re := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
 	dur, _ := time.ParseDuration(`1s`)
-	s := newMemoryStore(func()Entity{return &testEntity{}}, func(e Entity)Entity{return e}, dur)
+	s := newMemoryStore(func()Entity{return &testEntity{}}, func(e Entity)Entity{return e}, dur, newConfig(nil))
 
 	id, e, err := s.Create()
 
@@ -101,7 +101,8 @@ func Test_GaeStore(t *testing.T){
 	c, _ := aetest.NewContext(nil)
 	ctx := appengine.NewContext(c.Request().(*http.Request))
 	dur, _ := time.ParseDuration(`1s`)
-	s := newGaeStore(`testEntity`, ctx, func()Entity{return &testEntity{}}, func(e Entity)Entity{return e}, dur ,dur)
+	clock := NewFakeClock(now())
+	s := newGaeStore(`testEntity`, ctx, func()Entity{return &testEntity{}}, func(e Entity)Entity{return e}, dur ,dur, newConfig([]Option{WithClock(clock)}))
 
 	id, e, err := s.Create()
 	te := e.(*testEntity)
@@ -132,11 +133,7 @@ func Test_GaeStore(t *testing.T){
 	assert.Nil(t, err, `err should be nil`)
 
 	te = e.(*testEntity)
-	for {
-		if now().After(te.DeleteAfter) {
-			break
-		}
-	}
+	clock.Set(te.DeleteAfter)
 
 	id2, e, err := s.Create()
 
@@ -155,6 +152,25 @@ func Test_GaeStore(t *testing.T){
 	assert.Nil(t, err, `err should be nil`)
 }
 
+func Test_GaeStore_removeRecords(t *testing.T){
+	c, _ := aetest.NewContext(nil)
+	ctx := appengine.NewContext(c.Request().(*http.Request))
+	dur, _ := time.ParseDuration(`1s`)
+	clock := NewFakeClock(now())
+	s := newGaeStore(`testEntity`, ctx, func()Entity{return &testEntity{}}, func(e Entity)Entity{return e}, dur, dur, newConfig([]Option{WithClock(clock)})).(*entityStore)
+	id, _, _ := s.Create()
+	s.appendLog([]*ActionLogEntry{{EntityId: id, Version: 1, At: clock.Now()}})
+	s.putLifetime(id, &lifetimeRecord{CreatedAt: clock.Now()})
+
+	err := s.Delete(id)
+	log, _ := s.readLog(id)
+	lifetime, _ := s.readLifetime(id)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, 0, len(log), `the log should be deleted with the entity`)
+	assert.Nil(t, lifetime, `the lifetime should be deleted with the entity`)
+}
+
 type testEntity struct{
 	Version 	int 		`datastore:",noindex"`
 	DeleteAfter time.Time 	`datastore:""`
@@ -0,0 +1,186 @@
+/*
+Package joaktest runs joak entity implementations on a local httptest.Server
+and provides simulated clients, each with their own cookie jar, to drive them end to end.
+ */
+package joaktest
+
+import(
+	`time`
+	`bytes`
+	`errors`
+	`testing`
+	`net/url`
+	`net/http`
+	`io/ioutil`
+	`encoding/json`
+	`net/http/cookiejar`
+	`net/http/httptest`
+	`github.com/0xor1/oak`
+	`github.com/0xor1/joak`
+	`github.com/gorilla/mux`
+)
+
+const(
+	sessionName	= `joaktest`
+	authKey		= `joaktest-auth-key-0123456789abcd`
+	cryptKey	= `joaktest-crypt-key-0123456789abc`
+)
+
+type Harness struct{
+	Server	*httptest.Server
+	Routes	*joak.Routes
+}
+
+// Starts joak.RouteLocalTest on a new httptest.Server, Close must be called when finished with.
+func New(ef joak.EntityFactory, ei joak.EntityInitializer, entity joak.Entity, getJoinResp oak.GetJoinResp, getEntityChangeResp oak.GetEntityChangeResp, performAct oak.PerformAct, deleteAfter time.Duration, opts ...joak.Option) *Harness {
+	router := mux.NewRouter()
+	routes := joak.RouteLocalTest(router, ef, ei, 300, sessionName, authKey, cryptKey, ``, ``, entity, getJoinResp, getEntityChangeResp, performAct, deleteAfter, opts...)
+	return &Harness{httptest.NewServer(router), routes}
+}
+
+func (h *Harness) Close() {
+	h.Server.Close()
+}
+
+// Creates a new client with an empty cookie jar.
+func (h *Harness) Client() *Client {
+	jar, _ := cookiejar.New(nil)
+	u, _ := url.Parse(h.Server.URL)
+	return &Client{h.Server.URL, u, &http.Client{Jar: jar}}
+}
+
+// Creates count new clients, each with their own empty cookie jar.
+func (h *Harness) Clients(count int) []*Client {
+	cs := make([]*Client, count, count)
+	for i := range cs {
+		cs[i] = h.Client()
+	}
+	return cs
+}
+
+type Client struct{
+	baseUrl	string
+	url		*url.URL
+	http	*http.Client
+}
+
+type Resp struct{
+	Status	int
+	Body	string
+	Json	oak.Json
+}
+
+// Returns the entity version in the response, or -1 if the response did not include one.
+func (r *Resp) Version() int {
+	if v, ok := r.Json[`v`].(float64); ok {
+		return int(v)
+	}
+	return -1
+}
+
+func (c *Client) Create() (entityId string, err error) {
+	resp, err := c.Post(`/create`, nil)
+	if err != nil {
+		return ``, err
+	}
+	if resp.Status != http.StatusOK {
+		return ``, errors.New(resp.Body)
+	}
+	entityId, _ = resp.Json[`id`].(string)
+	return entityId, nil
+}
+
+func (c *Client) Join(entityId string) (*Resp, error) {
+	return c.Post(`/join`, oak.Json{`id`: entityId})
+}
+
+func (c *Client) Poll(entityId string, version int) (*Resp, error) {
+	return c.Post(`/poll`, oak.Json{`id`: entityId, `v`: version})
+}
+
+// Follows an entity through joak.WithSpectators, pass a negative version to always get a response.
+func (c *Client) Spectate(entityId string, version int) (*Resp, error) {
+	if version < 0 {
+		return c.Post(`/spectate`, oak.Json{`id`: entityId})
+	}
+	return c.Post(`/spectate`, oak.Json{`id`: entityId, `v`: version})
+}
+
+func (c *Client) Act(act oak.Json) (*Resp, error) {
+	return c.Post(`/act`, act)
+}
+
+func (c *Client) Leave() (*Resp, error) {
+	return c.Post(`/leave`, nil)
+}
+
+// Fetches a csrf token so subsequent requests from this client pass joak.WithCsrfToken.
+func (c *Client) FetchCsrfToken() error {
+	resp, err := c.Post(`/csrf`, nil)
+	if err == nil && resp.Status != http.StatusOK {
+		err = errors.New(resp.Body)
+	}
+	return err
+}
+
+// Posts body as json to path, sending the Origin and csrf headers a browser client would.
+func (c *Client) Post(path string, body oak.Json) (*Resp, error) {
+	var d []byte
+	if body != nil {
+		d, _ = json.Marshal(body)
+	}
+	req, err := http.NewRequest(`POST`, c.baseUrl + path, bytes.NewReader(d))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(`Content-Type`, `application/json`)
+	req.Header.Set(`Origin`, c.baseUrl)
+	for _, cookie := range c.http.Jar.Cookies(c.url) {
+		if cookie.Name == sessionName + `_csrf` {
+			req.Header.Set(`X-Csrf-Token`, cookie.Value)
+		}
+	}
+	httpResp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	d, err = ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, err
+	}
+	resp := &Resp{Status: httpResp.StatusCode, Body: string(d), Json: oak.Json{}}
+	json.Unmarshal(d, &resp.Json)
+	return resp, nil
+}
+
+// Fails t unless resp has status 200 and entity version v.
+func AssertVersion(t testing.TB, resp *Resp, v int) {
+	if resp == nil {
+		t.Errorf(`expected version %d but resp was nil`, v)
+		return
+	}
+	if resp.Status != http.StatusOK {
+		t.Errorf(`expected version %d but status was %d: %s`, v, resp.Status, resp.Body)
+		return
+	}
+	if resp.Version() != v {
+		t.Errorf(`expected version %d but got %d`, v, resp.Version())
+	}
+}
+
+// Fails t unless every resp has status 200 and the entity versions are strictly increasing.
+func AssertVersionProgression(t testing.TB, resps ...*Resp) {
+	last := -1
+	for i, resp := range resps {
+		if resp == nil || resp.Status != http.StatusOK {
+			t.Errorf(`resp %d was not successful`, i)
+			return
+		}
+		if resp.Version() <= last {
+			t.Errorf(`resp %d has version %d which does not follow version %d`, i, resp.Version(), last)
+			return
+		}
+		last = resp.Version()
+	}
+}
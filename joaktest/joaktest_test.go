@@ -0,0 +1,92 @@
+package joaktest
+
+import(
+	`time`
+	`errors`
+	`testing`
+	`net/http`
+	`github.com/0xor1/oak`
+	`github.com/0xor1/joak`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_Harness(t *testing.T){
+	dur, _ := time.ParseDuration(`1m`)
+	h := New(func()joak.Entity{return &counter{}}, func(e joak.Entity)joak.Entity{return e}, &counter{}, getResp, getResp, performAct, dur, joak.WithCsrfToken(), joak.WithOriginCheck())
+	defer h.Close()
+	cs := h.Clients(2)
+
+	_, err := cs[0].Create()
+
+	assert.NotNil(t, err, `create without a csrf token should fail`)
+
+	cs[0].FetchCsrfToken()
+	cs[1].FetchCsrfToken()
+	id, err := cs[0].Create()
+
+	assert.NotEqual(t, ``, id, `id should not be empty`)
+	assert.Nil(t, err, `err should be nil`)
+
+	join, err := cs[1].Join(id)
+
+	assert.Nil(t, err, `err should be nil`)
+	AssertVersion(t, join, 1)
+
+	act1, _ := cs[0].Act(oak.Json{`n`: 2})
+	act2, _ := cs[1].Act(oak.Json{`n`: 3})
+	poll, _ := cs[0].Poll(id, act1.Version())
+
+	AssertVersionProgression(t, join, act1, act2)
+	AssertVersion(t, poll, 3)
+	assert.Equal(t, float64(5), poll.Json[`count`], `count should include both acts`)
+
+	bad, _ := cs[1].Act(oak.Json{`n`: -1})
+
+	assert.Equal(t, http.StatusInternalServerError, bad.Status, `invalid acts should fail`)
+
+	leave, _ := cs[1].Leave()
+
+	assert.Equal(t, http.StatusOK, leave.Status, `leave should succeed`)
+
+	noop, _ := cs[1].Act(oak.Json{`n`: 1})
+
+	assert.Contains(t, noop.Body, `no entity in session`, `a client that left should not be able to act`)
+}
+
+type counter struct{
+	Version		int
+	Count		int
+	Players		int
+	DeleteAfter	time.Time
+}
+
+func (c *counter) GetVersion() int { return c.Version }
+func (c *counter) IncrementVersion() { c.Version++ }
+func (c *counter) DecrementVersion() { c.Version-- }
+func (c *counter) SetDeleteAfter(t time.Time) { c.DeleteAfter = t }
+func (c *counter) IsActive() bool { return true }
+func (c *counter) CreatedBy() string { return `0` }
+func (c *counter) Kick() bool { return false }
+
+func (c *counter) RegisterNewUser() (string, error) {
+	c.Players++
+	return string('0' + rune(c.Players)), nil
+}
+
+func (c *counter) UnregisterUser(userId string) error {
+	c.Players--
+	return nil
+}
+
+func getResp(userId string, e oak.Entity) oak.Json {
+	return oak.Json{`count`: e.(*counter).Count}
+}
+
+func performAct(json oak.Json, userId string, e oak.Entity) error {
+	n, _ := json[`n`].(float64)
+	if n < 0 {
+		return errors.New(`n must not be negative`)
+	}
+	e.(*counter).Count += int(n)
+	return nil
+}
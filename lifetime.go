@@ -0,0 +1,114 @@
+package joak
+
+import(
+	`sync`
+	`time`
+)
+
+// Expires entities maxLifetime after they were created however often they are updated, and when idleTimeout is positive
+// it replaces the deleteAfter the routes were set up with as the time an entity may go without being updated.
+// Either limit may be zero, Read expires entities that are past either one.
+func WithLifetime(maxLifetime time.Duration, idleTimeout time.Duration) Option {
+	return func(c *config) {
+		c.maxLifetime = maxLifetime
+		c.idleTimeout = idleTimeout
+	}
+}
+
+func (c *config) slidingDeleteAfter(deleteAfter time.Duration) time.Duration {
+	if c.idleTimeout > 0 {
+		return c.idleTimeout
+	}
+	return deleteAfter
+}
+
+type lifetimeRecord struct{
+	CreatedAt	time.Time
+	IdleUntil	time.Time	`datastore:",noindex"`
+}
+
+// Returns nil when lifetimes are not being tracked.
+func (es *entityStore) lifetime(entityId string) (*lifetimeRecord, error) {
+	if !es.trackLifetime {
+		return nil, nil
+	}
+	r, err := es.readLifetime(entityId)
+	if err != nil || r != nil {
+		return r, err
+	}
+	// entities created before lifetimes were tracked start their lifetime now, the record is written by their next update
+	return &lifetimeRecord{CreatedAt: es.clock.Now()}, nil
+}
+
+// Returns when the entity reaches its maximum lifetime, or the zero time when there is no maximum.
+func (es *entityStore) lifetimeEnd(r *lifetimeRecord) time.Time {
+	if r == nil || es.maxLifetime <= 0 {
+		return time.Time{}
+	}
+	return r.CreatedAt.Add(es.maxLifetime)
+}
+
+func (es *entityStore) expired(r *lifetimeRecord) bool {
+	if r == nil {
+		return false
+	}
+	at := es.clock.Now()
+	end := es.lifetimeEnd(r)
+	return (!end.IsZero() && !at.Before(end)) || (!r.IdleUntil.IsZero() && !at.Before(r.IdleUntil))
+}
+
+func (es *entityStore) expiresAt(e Entity, end time.Time) time.Time {
+	at := es.clock.Now().Add(entityTTL(e, es.deleteAfter))
+	if !end.IsZero() && end.Before(at) {
+		return end
+	}
+	return at
+}
+
+func (es *entityStore) expire(entityId string, e Entity) error {
+	es.hooks.run(`OnExpire`, es.hooks.OnExpire, entityId, e)
+	es.remove(entityId)
+	return &nonExtantError{&entityDoesNotExistError{entityId}}
+}
+
+// The lifetime ends of entities being updated. The memory and SQL stores work out the delete after they store from the ttl of
+// the entity, so they look it up here to cap it, an entity that is not here is being created and has its whole lifetime ahead.
+type lifetimeEnds struct{
+	mtx		sync.Mutex
+	ends	map[interface{}]time.Time
+}
+
+func (l *lifetimeEnds) set(v interface{}, end time.Time) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.ends[v] = end
+}
+
+func (l *lifetimeEnds) remove(v interface{}) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	delete(l.ends, v)
+}
+
+func (l *lifetimeEnds) get(v interface{}) (time.Time, bool) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	end, exists := l.ends[v]
+	return end, exists
+}
+
+// Returns the ttl to store v with, capped at the end of its maximum lifetime.
+func (c *config) storedTTL(v interface{}, deleteAfter time.Duration) time.Duration {
+	ttl := entityTTL(v, deleteAfter)
+	if c.maxLifetime <= 0 {
+		return ttl
+	}
+	remaining := c.maxLifetime
+	if end, exists := c.lifetimeEnds.get(v); exists {
+		remaining = end.Sub(c.clock.Now())
+	}
+	if remaining < ttl {
+		return remaining
+	}
+	return ttl
+}
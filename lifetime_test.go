@@ -0,0 +1,93 @@
+package joak
+
+import(
+	`time`
+	`testing`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_MemoryStore_WithLifetime(t *testing.T){
+	clock := NewFakeClock(now())
+	dur, _ := time.ParseDuration(`1h`)
+	s := newMemoryStore(func()Entity{return &testEntity{}}, func(e Entity)Entity{return e}, dur, newConfig([]Option{WithClock(clock), WithLifetime(10 * time.Minute, 2 * time.Minute)})).(*entityStore)
+
+	id, e, _ := s.Create()
+	s.Update(id, e)
+
+	assert.Equal(t, clock.Now().Add(2 * time.Minute), e.(*testEntity).DeleteAfter, `the idle timeout should replace deleteAfter`)
+
+	for i := 0; i < 9; i++ {
+		clock.Advance(time.Minute)
+		err := s.Update(id, e)
+
+		assert.Nil(t, err, `updates within both limits should succeed`)
+	}
+
+	assert.Equal(t, clock.Now().Add(time.Minute), e.(*testEntity).DeleteAfter, `DeleteAfter should not pass the maximum lifetime`)
+
+	clock.Advance(time.Minute)
+	_, err := s.Read(id)
+
+	assert.True(t, isNonExtantError(err), `reads past the maximum lifetime should fail as non extant`)
+
+	_, err = s.inner.Read(id)
+
+	assert.NotNil(t, err, `entities past the maximum lifetime should be deleted`)
+
+	id, e, _ = s.Create()
+	clock.Advance(time.Minute)
+	_, err = s.Read(id)
+
+	assert.Nil(t, err, `reads within the idle timeout should succeed`)
+
+	clock.Advance(time.Minute)
+	_, err = s.Read(id)
+
+	assert.True(t, isNonExtantError(err), `reads past the idle timeout should fail as non extant`)
+
+	id, e, _ = s.Create()
+	clock.Advance(3 * time.Minute)
+	err = s.Update(id, e)
+
+	assert.True(t, isNonExtantError(err), `updates past the idle timeout should fail as non extant`)
+}
+
+func Test_MemoryStore_WithLifetime_storedDeleteAfter(t *testing.T){
+	clock := NewFakeClock(now())
+	s := newMemoryStore(func()Entity{return &testEntity{}}, func(e Entity)Entity{return e}, time.Hour, newConfig([]Option{WithClock(clock), WithLifetime(10 * time.Minute, 0)})).(*entityStore)
+	end := clock.Now().Add(10 * time.Minute)
+
+	id, e, _ := s.Create()
+	_, deleteAfters, _ := s.list(clock.Now())
+
+	assert.Equal(t, []time.Time{end}, deleteAfters, `the stored delete after should be capped at the maximum lifetime on create`)
+
+	clock.Advance(5 * time.Minute)
+	s.Update(id, e)
+	_, deleteAfters, _ = s.list(clock.Now())
+
+	assert.Equal(t, []time.Time{end}, deleteAfters, `the stored delete after should be capped at the maximum lifetime on update`)
+	assert.Equal(t, end, e.(*testEntity).DeleteAfter, `DeleteAfter should not pass the maximum lifetime`)
+}
+
+func Test_MemoryStore_WithLifetime_readDoesNotWrite(t *testing.T){
+	clock := NewFakeClock(now())
+	s := newMemoryStore(func()Entity{return &testEntity{}}, func(e Entity)Entity{return e}, time.Hour, newConfig([]Option{WithClock(clock)})).(*entityStore)
+	id, e, _ := s.Create()
+	s.trackLifetime, s.maxLifetime = true, 10 * time.Minute
+	writes := 0
+	putLifetime := s.putLifetime
+	s.putLifetime = func(entityId string, r *lifetimeRecord) error {
+		writes++
+		return putLifetime(entityId, r)
+	}
+
+	_, err := s.Read(id)
+
+	assert.Nil(t, err, `entities created before lifetimes were tracked should be readable`)
+	assert.Equal(t, 0, writes, `reads should not write the lifetime record`)
+
+	s.Update(id, e)
+
+	assert.Equal(t, 1, writes, `updates should write the lifetime record`)
+}
@@ -0,0 +1,195 @@
+package joak
+
+import(
+	`fmt`
+	`math`
+	`sort`
+	`time`
+	`errors`
+	`strconv`
+	`strings`
+	`net/http`
+	`encoding/json`
+	`encoding/base64`
+	`github.com/0xor1/oak`
+)
+
+const(
+	_LOBBY					= `/lobby`
+	_LOBBY_DEFAULT_LIMIT	= 20
+	_LOBBY_MAX_LIMIT		= 100
+)
+
+type LobbyEntry struct{
+	Id			string		`json:"id"`
+	CreatedAt	time.Time	`json:"createdAt"`
+	CreatedBy	string		`json:"createdBy"`
+	Players		int			`json:"players"`
+	Summary		oak.Json	`json:"summary,omitempty"`
+}
+
+// Returns the current player count and the public summary fields to list an entity with.
+type LobbySummary func(e Entity) (players int, summary oak.Json)
+
+// Adds a GET /lobby route listing joinable entities oldest first. It takes limit, cursor and a query parameter for each
+// of filterFields and rejects any other. An entity is joinable while it IsActive and, with WithMatchmaking, isOpen.
+func WithLobby(summarize LobbySummary, filterFields ...string) Option {
+	return func(c *config) {
+		c.lobbySummary = summarize
+		c.routes = append(c.routes, extraRoute{_LOBBY, func(env *routeEnv) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				query := r.URL.Query()
+				limit := _LOBBY_DEFAULT_LIMIT
+				if l := query.Get(`limit`); l != `` {
+					var err error
+					if limit, err = strconv.Atoi(l); err != nil || limit < 1 || limit > _LOBBY_MAX_LIMIT {
+						http.Error(w, `limit must be a number from 1 to ` + strconv.Itoa(_LOBBY_MAX_LIMIT), http.StatusBadRequest)
+						return
+					}
+				}
+				filters := map[string]string{}
+				for k := range query {
+					if k == `limit` || k == `cursor` {
+						continue
+					}
+					if !containsString(filterFields, k) {
+						http.Error(w, `unknown lobby query parameter ` + strconv.Quote(k), http.StatusBadRequest)
+						return
+					}
+					filters[k] = query.Get(k)
+				}
+				entries, cursor, err := ListLobby(env.entityStoreFactory(r), query.Get(`cursor`), limit, filters)
+				if err != nil {
+					writeError(w, err)
+					return
+				}
+				respJson := oak.Json{`entries`: entries}
+				if cursor != `` {
+					respJson[`cursor`] = cursor
+				}
+				writeJson(w, &respJson)
+			})
+		}})
+	}
+}
+
+// Returns up to limit joinable entities after cursor matching filters, and the next cursor, empty on the last page.
+func ListLobby(store oak.EntityStore, cursor string, limit int, filters map[string]string) ([]*LobbyEntry, string, error) {
+	es, ok := store.(*entityStore)
+	if !ok {
+		return nil, ``, errors.New(`store must be a joak entity store`)
+	}
+	after, err := parseLobbyCursor(cursor)
+	if err != nil {
+		return nil, ``, err
+	}
+	at := es.clock.Now()
+	entries := []*LobbyEntry{}
+	for {
+		batch, err := es.listLobby(at, after, limit)
+		if err != nil {
+			return nil, ``, err
+		}
+		for _, entry := range batch {
+			after = lobbyCursor{entry.CreatedAt, entry.Id}
+			if matchesLobbyFilters(entry, filters) {
+				entries = append(entries, entry)
+				if len(entries) == limit {
+					return entries, after.String(), nil
+				}
+			}
+		}
+		if len(batch) < limit {
+			return entries, ``, nil
+		}
+	}
+}
+
+func matchesLobbyFilters(entry *LobbyEntry, filters map[string]string) bool {
+	for k, v := range filters {
+		if field, exists := entry.Summary[k]; !exists || fmt.Sprint(field) != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (es *entityStore) indexLobby(entityId string, e Entity) {
+	if es.lobbySummary == nil {
+		return
+	}
+	if !e.IsActive() || (es.isOpen != nil && !es.isOpen(e)) {
+		es.removeLobby(entityId)
+		return
+	}
+	players, summary := es.lobbySummary(e)
+	at := es.clock.Now()
+	es.putLobby(&LobbyEntry{entityId, at, e.CreatedBy(), players, summary}, at.Add(es.storedTTL(e, es.deleteAfter)))
+}
+
+type lobbyCursor struct{
+	createdAt	time.Time
+	id			string
+}
+
+// Reports whether an entry created at createdAt with id comes after the cursor.
+func (c lobbyCursor) before(createdAt time.Time, id string) bool {
+	return createdAt.After(c.createdAt) || (createdAt.Equal(c.createdAt) && id > c.id)
+}
+
+func (c lobbyCursor) nanos() int64 {
+	if c.createdAt.IsZero() {
+		return math.MinInt64
+	}
+	return c.createdAt.UnixNano()
+}
+
+func (c lobbyCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(c.createdAt.UnixNano(), 10) + `.` + c.id))
+}
+
+func parseLobbyCursor(cursor string) (lobbyCursor, error) {
+	if cursor == `` {
+		return lobbyCursor{}, nil
+	}
+	invalid := errors.New(`invalid lobby cursor`)
+	d, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return lobbyCursor{}, invalid
+	}
+	parts := strings.SplitN(string(d), `.`, 2)
+	if len(parts) != 2 {
+		return lobbyCursor{}, invalid
+	}
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return lobbyCursor{}, invalid
+	}
+	return lobbyCursor{time.Unix(0, nanos).UTC(), parts[1]}, nil
+}
+
+type lobbyByCreatedAt []*LobbyEntry
+
+func (l lobbyByCreatedAt) Len() int { return len(l) }
+func (l lobbyByCreatedAt) Less(i, j int) bool { return lobbyCursor{l[i].CreatedAt, l[i].Id}.before(l[j].CreatedAt, l[j].Id) }
+func (l lobbyByCreatedAt) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+
+func sortLobby(entries []*LobbyEntry) {
+	sort.Sort(lobbyByCreatedAt(entries))
+}
+
+type lobbyRecord struct{
+	CreatedAt	time.Time
+	CreatedBy	string		`datastore:",noindex"`
+	Players		int			`datastore:",noindex"`
+	Summary		[]byte		`datastore:",noindex"`
+	DeleteAfter	time.Time
+}
+
+func (r *lobbyRecord) entry(entityId string) (*LobbyEntry, error) {
+	entry := &LobbyEntry{Id: entityId, CreatedAt: r.CreatedAt, CreatedBy: r.CreatedBy, Players: r.Players}
+	if err := json.Unmarshal(r.Summary, &entry.Summary); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
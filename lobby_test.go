@@ -0,0 +1,94 @@
+package joak
+
+import(
+	`time`
+	`testing`
+	`net/http`
+	`encoding/json`
+	`net/http/httptest`
+	`github.com/0xor1/oak`
+	`github.com/gorilla/mux`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_WithLobby(t *testing.T){
+	clock := NewFakeClock(now())
+	dur, _ := time.ParseDuration(`1m`)
+	router := mux.NewRouter()
+	isOpen := func(e Entity) bool { return e.(*actTestEntity).Players < 2 }
+	summarize := func(e Entity) (int, oak.Json) { return e.(*actTestEntity).Players, oak.Json{`count`: e.(*actTestEntity).Count} }
+	routes := RouteLocalTest(router, func()Entity{return &actTestEntity{}}, func(e Entity)Entity{return e}, 300, `test`, `auth`, `crypt-key-0123456789abcdefghijkl`, ``, ``, &actTestEntity{}, actTestResp, actTestResp, actTestPerformAct, dur, WithClock(clock), WithMatchmaking(isOpen), WithLobby(summarize, `count`))
+	r, _ := http.NewRequest(`GET`, `/`, nil)
+	store := routes.EntityStore(r)
+
+	ids := []string{}
+	for i := 0; i < 5; i++ {
+		id, _, _ := store.Create()
+		ids = append(ids, id)
+		clock.Advance(time.Second)
+	}
+	e, _ := store.Read(ids[1])
+	e.(Entity).RegisterNewUser()
+	e.(Entity).RegisterNewUser()
+	store.Update(ids[1], e)
+	e, _ = store.Read(ids[2])
+	e.(*actTestEntity).Count = 7
+	e.(Entity).RegisterNewUser()
+	store.Update(ids[2], e)
+
+	entries, cursor, err := ListLobby(store, ``, 2, nil)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, 2, len(entries), `a page should have limit entries`)
+	assert.Equal(t, ids[0], entries[0].Id, `entries should be oldest first`)
+	assert.Equal(t, ids[2], entries[1].Id, `full entities should not be listed`)
+	assert.Equal(t, 1, entries[1].Players, `player count should be listed`)
+	assert.Equal(t, float64(7), entries[1].Summary[`count`], `summary fields should be listed`)
+	assert.Equal(t, `created_by`, entries[1].CreatedBy, `creator should be listed`)
+	assert.Equal(t, 2 * time.Second, entries[1].CreatedAt.Sub(entries[0].CreatedAt), `created time should not change on update`)
+
+	entries, cursor, err = ListLobby(store, cursor, 2, nil)
+
+	assert.Equal(t, []string{ids[3], ids[4]}, []string{entries[0].Id, entries[1].Id}, `the cursor should continue from the previous page`)
+
+	entries, cursor, err = ListLobby(store, cursor, 2, nil)
+
+	assert.Equal(t, 0, len(entries), `there should be no more entries`)
+	assert.Equal(t, ``, cursor, `the last page should have no cursor`)
+
+	entries, _, _ = ListLobby(store, ``, 10, map[string]string{`count`: `7`})
+
+	assert.Equal(t, 1, len(entries), `filters should match summary fields`)
+	assert.Equal(t, ids[2], entries[0].Id, `filters should match summary fields`)
+
+	clock.Advance(dur - 3 * time.Second)
+	entries, _, _ = ListLobby(store, ``, 10, nil)
+
+	assert.Equal(t, 3, len(entries), `expired entities should not be listed`)
+	assert.Equal(t, ids[2], entries[0].Id, `expired entities should not be listed`)
+
+	w := httptest.NewRecorder()
+	r, _ = http.NewRequest(`GET`, `/lobby?limit=1&count=7`, nil)
+	router.ServeHTTP(w, r)
+	resp := struct{
+		Entries	[]*LobbyEntry
+		Cursor	string
+	}{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+
+	assert.Equal(t, http.StatusOK, w.Code, `lobby route should succeed`)
+	assert.Equal(t, ids[2], resp.Entries[0].Id, `lobby route should filter on query parameters`)
+	assert.NotEqual(t, ``, resp.Cursor, `a full page should have a cursor`)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest(`GET`, `/lobby?limit=1000`, nil)
+	router.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code, `limit should be bounded`)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest(`GET`, `/lobby?players=1`, nil)
+	router.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code, `filters on undeclared fields should be rejected`)
+}
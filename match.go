@@ -0,0 +1,110 @@
+package joak
+
+import(
+	`time`
+	`net/http`
+	`github.com/0xor1/oak`
+	`github.com/gorilla/sessions`
+)
+
+const(
+	_MATCH				= `/match`
+	_MATCH_CANDIDATES	= 10
+)
+
+// Adds a /match route joining the session to an active entity isOpen reports free seats in, or creating one when there
+// are none. Backends index the entities isOpen returned true for on their last write.
+func WithMatchmaking(isOpen func(e Entity) bool) Option {
+	return func(c *config) {
+		c.isOpen = isOpen
+		c.routes = append(c.routes, extraRoute{_MATCH, func(env *routeEnv) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				es, ok := env.entityStoreFactory(r).(*entityStore)
+				if !ok {
+					http.Error(w, `store must be a joak entity store`, 500)
+					return
+				}
+				s, _ := env.sessionStore.Get(r, env.sessionName)
+				if e, _ := s.Values[_ENTITY].(Entity); e != nil && e.IsActive() {
+					entityId, _ := s.Values[_ENTITY_ID].(string)
+					userId, _ := s.Values[_USER_ID].(string)
+					if current, err := es.Read(entityId); err == nil && current.IsActive() {
+						writeMatchResp(w, env, userId, entityId, current.(Entity))
+						return
+					}
+				}
+				userId, entityId, e, err := match(es, env.wrapStore(r, es))
+				if err != nil {
+					writeError(w, err)
+					return
+				}
+				s.Values = map[interface{}]interface{}{
+					_USER_ID: userId,
+					_ENTITY_ID: entityId,
+					_ENTITY: e,
+				}
+				if err = sessions.Save(r, w); err != nil {
+					writeError(w, err)
+					return
+				}
+				writeMatchResp(w, env, userId, entityId, e)
+			})
+		}})
+	}
+}
+
+// Tries up to _MATCH_CANDIDATES open entities, moving on when another user takes the seat first. Writes go through
+// store, the wrapped es, so they are seen by the same wrappers as oak's routes.
+func match(es *entityStore, store oak.EntityStore) (userId string, entityId string, e Entity, err error) {
+	ids, err := es.listOpen(es.clock.Now())
+	if err != nil {
+		return
+	}
+	if len(ids) > _MATCH_CANDIDATES {
+		ids = ids[:_MATCH_CANDIDATES]
+	}
+	for _, id := range ids {
+		v, err := store.Read(id)
+		if err != nil {
+			continue
+		}
+		candidate := v.(Entity)
+		if !candidate.IsActive() || !es.isOpen(candidate) {
+			es.setOpen(id, false, time.Time{})
+			continue
+		}
+		if userId, err = candidate.RegisterNewUser(); err != nil {
+			continue
+		}
+		if err = store.Update(id, candidate); err == nil {
+			return userId, id, candidate, nil
+		}
+	}
+	entityId, v, err := store.Create()
+	if err != nil {
+		return
+	}
+	e = v.(Entity)
+	return e.CreatedBy(), entityId, e, nil
+}
+
+func writeMatchResp(w http.ResponseWriter, env *routeEnv, userId string, entityId string, e Entity) {
+	respJson := oak.Json{}
+	if env.getJoinResp != nil {
+		respJson = env.getJoinResp(userId, e)
+	}
+	respJson[_ID] = entityId
+	respJson[_VERSION] = e.GetVersion()
+	writeJson(w, &respJson)
+}
+
+func (es *entityStore) indexOpen(entityId string, e Entity) {
+	if es.isOpen == nil {
+		return
+	}
+	es.setOpen(entityId, e.IsActive() && es.isOpen(e), es.clock.Now().Add(es.storedTTL(e, es.deleteAfter)))
+}
+
+type openRecord struct{
+	DeleteAfter	time.Time
+}
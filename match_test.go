@@ -0,0 +1,71 @@
+package joak
+
+import(
+	`time`
+	`testing`
+	`net/http`
+	`net/http/httptest`
+	`github.com/0xor1/oak`
+	`github.com/gorilla/mux`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_WithMatchmaking(t *testing.T){
+	dur, _ := time.ParseDuration(`1m`)
+	router := mux.NewRouter()
+	isOpen := func(e Entity) bool { return e.(*actTestEntity).Players < 2 }
+	RouteLocalTest(router, func()Entity{return &actTestEntity{}}, func(e Entity)Entity{return e}, 300, `test`, `auth`, `crypt-key-0123456789abcdefghijkl`, ``, ``, &actTestEntity{}, actTestResp, actTestResp, actTestPerformAct, dur, WithMatchmaking(isOpen))
+	server := httptest.NewServer(router)
+	defer server.Close()
+	cs := []*testClient{newTestClient(server), newTestClient(server), newTestClient(server), newTestClient(server)}
+
+	first := cs[0].post(`/match`, nil)
+
+	assert.NotNil(t, first[`id`], `the first match should create an entity`)
+	assert.Equal(t, float64(0), first[`v`], `the first match should create an entity`)
+
+	second := cs[1].post(`/match`, nil)
+	third := cs[2].post(`/match`, nil)
+
+	assert.Equal(t, first[`id`], second[`id`], `open entities should be joined`)
+	assert.Equal(t, float64(1), second[`v`], `joining should update the entity`)
+	assert.Equal(t, first[`id`], third[`id`], `open entities should be joined`)
+	assert.Equal(t, float64(2), third[`v`], `joining should update the entity`)
+
+	fourth := cs[3].post(`/match`, nil)
+
+	assert.NotEqual(t, first[`id`], fourth[`id`], `full entities should not be joined`)
+
+	again := cs[1].post(`/match`, nil)
+
+	assert.Equal(t, first[`id`], again[`id`], `an engaged session should stay in its entity`)
+	assert.Equal(t, float64(2), again[`v`], `an engaged session should not take another seat`)
+
+	resp := cs[2].post(`/act`, oak.Json{`n`: 2})
+
+	assert.Equal(t, float64(2), resp[`count`], `matched users should be able to act`)
+}
+
+func Test_WithMatchmaking_actionLog(t *testing.T){
+	router := mux.NewRouter()
+	isOpen := func(e Entity) bool { return e.(*actTestEntity).Players < 2 }
+	routes := RouteLocalTest(router, func()Entity{return &actTestEntity{}}, func(e Entity)Entity{return e}, 300, `test`, `auth`, `crypt-key-0123456789abcdefghijkl`, ``, ``, &actTestEntity{}, actTestResp, actTestResp, actTestPerformAct, time.Hour, WithMatchmaking(isOpen), WithActionLog())
+	server := httptest.NewServer(router)
+	defer server.Close()
+	c1, c2 := newTestClient(server), newTestClient(server)
+
+	id := c1.post(`/match`, nil)[`id`].(string)
+	c2.post(`/match`, nil)
+	c2.post(`/act`, oak.Json{`n`: 2})
+	r, _ := http.NewRequest(`GET`, `/`, nil)
+	store := routes.EntityStore(r)
+	entries, _ := ReadActionLog(store, id)
+
+	assert.Equal(t, 3, len(entries), `matched creates and joins should be logged`)
+
+	e, err := Replay(store, id, 2, actTestPerformAct)
+
+	assert.Nil(t, err, `replay should run across matched joins`)
+	assert.Equal(t, 1, e.(*actTestEntity).Players, `replayed entity should include the matched join`)
+	assert.Equal(t, 2, e.(*actTestEntity).Count, `replayed entity should include the act after the matched join`)
+}
@@ -0,0 +1,130 @@
+package joak
+
+import(
+	`strconv`
+	`strings`
+	`net/http`
+	`github.com/0xor1/oak`
+	`github.com/gorilla/sessions`
+	gctx `github.com/gorilla/context`
+)
+
+type preconditionKey int
+
+const _PRECONDITION_KEY preconditionKey = 0
+
+// Lets an /act carry the version the client last saw in an If-Match header, when the entity is at none of the versions listed the act
+// is not performed and the response is 409 Conflict with the getEntityChangeResp for the current entity, which is also saved to the
+// session as a /poll would.
+func WithVersionPreconditions() Option {
+	return func(c *config) {
+		c.wrappers = append(c.wrappers, func(r *http.Request, es oak.EntityStore) oak.EntityStore {
+			if p, ok := gctx.Get(r, _PRECONDITION_KEY).(*precondition); ok {
+				return &preconditionStore{es, p}
+			}
+			return es
+		})
+		c.middleware = append(c.middleware, func(env *routeEnv, path string, next http.Handler) http.Handler {
+			if path != _ACT {
+				return next
+			}
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ifMatch := r.Header.Get(`If-Match`)
+				if ifMatch == `` || ifMatch == `*` {
+					next.ServeHTTP(w, r)
+					return
+				}
+				p := &precondition{}
+				for _, tag := range strings.Split(ifMatch, `,`) {
+					version, err := parseVersionTag(tag)
+					if err != nil {
+						http.Error(w, `If-Match must be a list of entity versions`, http.StatusBadRequest)
+						return
+					}
+					p.versions = append(p.versions, version)
+				}
+				gctx.Set(r, _PRECONDITION_KEY, p)
+				defer gctx.Delete(r, _PRECONDITION_KEY)
+				bw := &bufferedWriter{header: http.Header{}, status: http.StatusOK}
+				next.ServeHTTP(bw, r)
+				if p.current == nil {
+					bw.flush(w)
+					return
+				}
+				for k, v := range bw.header {
+					w.Header()[k] = v
+				}
+				userId := env.getSessionString(r, _USER_ID)
+				if s, err := env.sessionStore.Get(r, env.sessionName); err == nil && s != nil && s.Values[_ENTITY_ID] == p.entityId {
+					if p.current.IsActive() {
+						s.Values[_ENTITY] = p.current
+					} else {
+						s.Values = map[interface{}]interface{}{}
+					}
+					if err = sessions.Save(r, w); err != nil {
+						writeError(w, err)
+						return
+					}
+				}
+				respJson := oak.Json{}
+				if env.getEntityChangeResp != nil {
+					respJson = env.getEntityChangeResp(userId, p.current)
+				}
+				respJson[_VERSION] = p.current.GetVersion()
+				w.Header().Set(`Content-Type`, `application/json`)
+				w.WriteHeader(http.StatusConflict)
+				writeJson(w, &respJson)
+			})
+		})
+	}
+}
+
+type precondition struct{
+	versions	[]int
+	entityId	string
+	current		oak.Entity
+}
+
+func (p *precondition) matches(version int) bool {
+	for _, v := range p.versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks the version when oak reads the entity to act on, the update that follows only succeeds if the entity is still at that version.
+type preconditionStore struct{
+	oak.EntityStore
+	p	*precondition
+}
+
+func (ps *preconditionStore) Read(entityId string) (oak.Entity, error) {
+	e, err := ps.EntityStore.Read(entityId)
+	if err == nil && !ps.p.matches(e.GetVersion()) {
+		ps.p.entityId, ps.p.current = entityId, e
+		return nil, &versionPreconditionError{entityId, ps.p.versions, e.GetVersion()}
+	}
+	return e, err
+}
+
+// Accepts a plain version or an entity tag holding one, such as "3" or W/"3".
+func parseVersionTag(tag string) (int, error) {
+	tag = strings.TrimPrefix(strings.TrimSpace(tag), `W/`)
+	return strconv.Atoi(strings.Trim(tag, `"`))
+}
+
+type versionPreconditionError struct{
+	id			string
+	expected	[]int
+	actual		int
+}
+
+func (e *versionPreconditionError) Error() string {
+	expected := make([]string, len(e.expected))
+	for i, v := range e.expected {
+		expected[i] = strconv.Itoa(v)
+	}
+	return `entity with id "` + e.id + `" is at version ` + strconv.Itoa(e.actual) + ` not ` + strings.Join(expected, ` or `)
+}
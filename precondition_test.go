@@ -0,0 +1,93 @@
+package joak
+
+import(
+	`time`
+	`errors`
+	`strings`
+	`testing`
+	`net/http`
+	`net/http/httptest`
+	`github.com/0xor1/oak`
+	`github.com/gorilla/mux`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_WithVersionPreconditions(t *testing.T){
+	router := mux.NewRouter()
+	routes := RouteLocalTest(router, func()Entity{return &actTestEntity{}}, func(e Entity)Entity{return e}, 300, `test`, `auth`, `crypt-key-0123456789abcdefghijkl`, ``, ``, &actTestEntity{}, actTestResp, actTestResp, actTestPerformAct, time.Hour, WithVersionPreconditions())
+	server := httptest.NewServer(router)
+	defer server.Close()
+	c1, c2 := newTestClient(server), newTestClient(server)
+	ifMatch := func(tag string) http.Header { return http.Header{`If-Match`: {tag}} }
+
+	id := c1.post(`/create`, nil)[`id`].(string)
+	c2.post(`/join`, oak.Json{`id`: id})
+	resp, respJson := c1.do(`/act`, ifMatch(`"1"`), oak.Json{`n`: 2})
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode, `an act at the current version should succeed`)
+	assert.Equal(t, float64(2), respJson[`count`], `an act at the current version should be performed`)
+
+	resp, respJson = c2.do(`/act`, ifMatch(`"1"`), oak.Json{`n`: 3})
+	r, _ := http.NewRequest(`GET`, `/`, nil)
+	e, _ := routes.EntityStore(r).Read(id)
+
+	assert.Equal(t, http.StatusConflict, resp.StatusCode, `an act at a stale version should conflict`)
+	assert.Equal(t, oak.Json{`count`: float64(2), `v`: float64(2)}, respJson, `a conflict should return the current state`)
+	assert.Equal(t, 2, e.(*actTestEntity).Count, `an act at a stale version should not be performed`)
+
+	resp, respJson = c2.do(`/act`, ifMatch(`W/"2"`), oak.Json{`n`: 3})
+
+	assert.Equal(t, float64(5), respJson[`count`], `weak entity tags should be accepted`)
+
+	resp, _ = c1.do(`/act`, ifMatch(`two`), oak.Json{`n`: 1})
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, `an If-Match that is not a version should be rejected`)
+
+	resp, respJson = c1.do(`/act`, ifMatch(`"7", W/"3"`), oak.Json{`n`: 0})
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode, `an If-Match listing the current version should succeed`)
+
+	resp, _ = c1.do(`/act`, ifMatch(`"7", "two"`), oak.Json{`n`: 0})
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, `an If-Match listing something that is not a version should be rejected`)
+
+	_, respJson = c1.do(`/act`, nil, oak.Json{`n`: 1})
+
+	assert.Equal(t, float64(6), respJson[`count`], `acts without If-Match should be performed`)
+}
+
+func Test_WithVersionPreconditions_conflictSession(t *testing.T){
+	// fails unless the count of the entity acted on is at, oak applies acts to the session entity before the stored one
+	performAct := func(json oak.Json, userId string, e oak.Entity) error {
+		if at, ok := json[`at`].(float64); ok && e.(*actTestEntity).Count != int(at) {
+			return errors.New(`count is not at the expected value`)
+		}
+		return actTestPerformAct(json, userId, e)
+	}
+	withInnerHeader := func(c *config) {
+		c.middleware = append(c.middleware, func(env *routeEnv, path string, next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set(`X-Inner`, `kept`)
+				next.ServeHTTP(w, r)
+			})
+		})
+	}
+	router := mux.NewRouter()
+	RouteLocalTest(router, func()Entity{return &actTestEntity{}}, func(e Entity)Entity{return e}, 300, `test`, `auth`, `crypt-key-0123456789abcdefghijkl`, ``, ``, &actTestEntity{}, actTestResp, actTestResp, performAct, time.Hour, WithVersionPreconditions(), withInnerHeader)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	c1, c2 := newTestClient(server), newTestClient(server)
+
+	id := c1.post(`/create`, nil)[`id`].(string)
+	c2.post(`/join`, oak.Json{`id`: id})
+	c1.post(`/act`, oak.Json{`n`: 1})
+	resp, _ := c2.do(`/act`, http.Header{`If-Match`: {`"1"`}}, oak.Json{`n`: 5})
+
+	assert.Equal(t, http.StatusConflict, resp.StatusCode, `an act at a stale version should conflict`)
+	assert.Equal(t, `kept`, resp.Header.Get(`X-Inner`), `a conflict should keep the headers set by the handlers it wraps`)
+	assert.True(t, strings.HasPrefix(resp.Header.Get(`Set-Cookie`), `test=`), `a conflict should save the session`)
+
+	_, respJson := c2.do(`/act`, nil, oak.Json{`n`: 1, `at`: 1})
+
+	assert.Equal(t, float64(2), respJson[`count`], `a conflict should update the session entity to the current one`)
+}
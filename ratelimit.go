@@ -0,0 +1,120 @@
+package joak
+
+import(
+	`net`
+	`math`
+	`time`
+	`sync`
+	`strconv`
+	`net/http`
+)
+
+type RateLimit struct{
+	PerSecond	float64
+	Burst		int
+}
+
+// Take must only consume a token from each key's bucket when every bucket has one, so a request denied by one key does
+// not use up the budget of the others.
+type RateLimitBackend interface{
+	Take(keys []string, limit RateLimit, at time.Time) (ok bool, retryAfter time.Duration)
+}
+
+// Limits requests to paths per client ip and per session user, or to /create, /poll and /act when no paths are given.
+func WithRateLimit(limit RateLimit, backend RateLimitBackend, paths ...string) Option {
+	if len(paths) == 0 {
+		paths = []string{_CREATE, _POLL, _ACT}
+	}
+	return func(c *config) {
+		c.middleware = append(c.middleware, func(env *routeEnv, path string, next http.Handler) http.Handler {
+			if !containsString(paths, path) {
+				return next
+			}
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				keys := []string{path + ` ip ` + clientIp(r)}
+				if userId := env.getSessionString(r, _USER_ID); userId != `` {
+					keys = append(keys, path + ` user ` + userId)
+				}
+				if ok, retryAfter := backend.Take(keys, limit, env.clock.Now()); !ok {
+					w.Header().Set(`Retry-After`, strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+					http.Error(w, `rate limit exceeded`, http.StatusTooManyRequests)
+					return
+				}
+				next.ServeHTTP(w, r)
+			})
+		})
+	}
+}
+
+func NewMemoryRateLimitBackend() RateLimitBackend {
+	return &memoryRateLimitBackend{buckets: map[string]*tokenBucket{}}
+}
+
+type tokenBucket struct{
+	limit	RateLimit
+	tokens	float64
+	last	time.Time
+}
+
+type memoryRateLimitBackend struct{
+	mtx		sync.Mutex
+	buckets	map[string]*tokenBucket
+	takes	int
+}
+
+func (b *memoryRateLimitBackend) Take(keys []string, limit RateLimit, at time.Time) (bool, time.Duration) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.takes++
+	if b.takes % 1000 == 0 {
+		b.prune(at)
+	}
+	tbs := make([]*tokenBucket, 0, len(keys))
+	minTokens := math.Inf(1)
+	for _, key := range keys {
+		tb, exists := b.buckets[key]
+		if !exists {
+			tb = &tokenBucket{limit, float64(limit.Burst), at}
+			b.buckets[key] = tb
+		}
+		tb.limit = limit
+		tb.tokens = math.Min(float64(limit.Burst), tb.tokens + at.Sub(tb.last).Seconds() * limit.PerSecond)
+		tb.last = at
+		tbs = append(tbs, tb)
+		minTokens = math.Min(minTokens, tb.tokens)
+	}
+	if minTokens >= 1 {
+		for _, tb := range tbs {
+			tb.tokens--
+		}
+		return true, 0
+	}
+	if limit.PerSecond <= 0 {
+		return false, time.Hour
+	}
+	return false, time.Duration((1 - minTokens) / limit.PerSecond * float64(time.Second))
+}
+
+func (b *memoryRateLimitBackend) prune(at time.Time) {
+	for key, tb := range b.buckets {
+		if tb.tokens + at.Sub(tb.last).Seconds() * tb.limit.PerSecond >= float64(tb.limit.Burst) {
+			delete(b.buckets, key)
+		}
+	}
+}
+
+func clientIp(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+func containsString(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package joak
+
+import(
+	`time`
+	`testing`
+	`net/http`
+	`net/http/httptest`
+	`github.com/gorilla/mux`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_MemoryRateLimitBackend(t *testing.T){
+	b := NewMemoryRateLimitBackend()
+	limit := RateLimit{PerSecond: 2, Burst: 2}
+	at := now()
+
+	ok, _ := b.Take([]string{`a`}, limit, at)
+
+	assert.True(t, ok, `first take should succeed`)
+
+	ok, _ = b.Take([]string{`a`}, limit, at)
+
+	assert.True(t, ok, `second take should succeed within burst`)
+
+	ok, retryAfter := b.Take([]string{`a`}, limit, at)
+
+	assert.False(t, ok, `third take should be limited`)
+	assert.Equal(t, 500 * time.Millisecond, retryAfter, `retryAfter should be the time until the next token`)
+
+	ok, _ = b.Take([]string{`b`}, limit, at)
+
+	assert.True(t, ok, `other keys should have their own bucket`)
+
+	ok, _ = b.Take([]string{`a`}, limit, at.Add(500 * time.Millisecond))
+
+	assert.True(t, ok, `take should succeed once a token has refilled`)
+
+	ok, _ = b.Take([]string{`c`, `a`}, limit, at.Add(500 * time.Millisecond))
+
+	assert.False(t, ok, `take should be limited when any key is limited`)
+
+	b.Take([]string{`c`}, limit, at.Add(500 * time.Millisecond))
+	ok, _ = b.Take([]string{`c`}, limit, at.Add(500 * time.Millisecond))
+
+	assert.True(t, ok, `a limited take should not use up the tokens of the other keys`)
+}
+
+func Test_WithRateLimit(t *testing.T){
+	router := mux.NewRouter()
+	dur, _ := time.ParseDuration(`1s`)
+	RouteLocalTest(router, func()Entity{return &testEntity{}}, func(e Entity)Entity{return e}, 300, ``, ``, ``, ``, `test`, &testEntity{}, nil, nil, nil, dur, WithRateLimit(RateLimit{PerSecond: 0.001, Burst: 1}, NewMemoryRateLimitBackend(), `/create`))
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest(`POST`, `/create`, nil)
+	r.RemoteAddr = `1.2.3.4:5678`
+	router.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code, `first create should be allowed`)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusTooManyRequests, w.Code, `second create should be limited`)
+	assert.Equal(t, `1000`, w.Header().Get(`Retry-After`), `Retry-After should be set in seconds`)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest(`POST`, `/leave`, nil)
+	r.RemoteAddr = `1.2.3.4:5678`
+	router.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code, `unlimited routes should not be affected`)
+}
+
+func Test_WithRateLimit_defaultPaths(t *testing.T){
+	router := mux.NewRouter()
+	dur, _ := time.ParseDuration(`1s`)
+	RouteLocalTest(router, func()Entity{return &testEntity{}}, func(e Entity)Entity{return e}, 300, ``, ``, ``, ``, `test`, &testEntity{}, nil, nil, nil, dur, WithRateLimit(RateLimit{PerSecond: 0.001, Burst: 1}, NewMemoryRateLimitBackend()))
+
+	r, _ := http.NewRequest(`POST`, `/create`, nil)
+	r.RemoteAddr = `1.2.3.4:5678`
+	router.ServeHTTP(httptest.NewRecorder(), r)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusTooManyRequests, w.Code, `create should be limited when no paths are given`)
+}
@@ -0,0 +1,258 @@
+package joak
+
+import(
+	`time`
+	`bytes`
+	`errors`
+	`strings`
+	`net/http`
+	`crypto/hmac`
+	`crypto/sha256`
+	`encoding/json`
+	`encoding/base64`
+	`github.com/0xor1/oak`
+	`github.com/gorilla/sessions`
+	gctx `github.com/gorilla/context`
+)
+
+const(
+	_RESUME				= `/resume`
+	_RESUME_TOKEN		= `resumeToken`
+	_RESUME_GENERATION	= `resumeGeneration`
+)
+
+type stickySessionKey int
+
+const _STICKY_SESSION_KEY stickySessionKey = 0
+
+// Adds a resumeToken to /create, /join and /match responses for users holding a seat in the entity, presenting it to /resume within validFor
+// restores the userId and entityId into the session of whichever client presents it. When invalidateOldSession is true each token can only
+// be used once and any session the seat was previously held in is cleared on its next request, otherwise the token returned by /resume
+// expires with the one presented so a token can not be used to extend itself.
+func WithResumeTokens(validFor time.Duration, invalidateOldSession bool) Option {
+	return func(c *config) {
+		c.stickySessionKeys = append(c.stickySessionKeys, _RESUME_GENERATION)
+		c.routes = append(c.routes, extraRoute{_RESUME, func(env *routeEnv) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				req := struct{
+					Token	string	`json:"resumeToken"`
+				}{}
+				if r.Body != nil {
+					json.NewDecoder(r.Body).Decode(&req)
+				}
+				rt, err := parseResumeToken(env.authKey, req.Token, env.clock.Now())
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusForbidden)
+					return
+				}
+				es, ok := env.entityStoreFactory(r).(*entityStore)
+				if !ok {
+					writeError(w, errors.New(`store must be a joak entity store`))
+					return
+				}
+				expires := rt.Expires
+				if invalidateOldSession {
+					claimed, err := es.claimResumeGeneration(rt.EntityId, rt.UserId, rt.Generation)
+					if err != nil {
+						writeError(w, err)
+						return
+					}
+					if !claimed {
+						http.Error(w, `resume token has already been used`, http.StatusForbidden)
+						return
+					}
+					rt.Generation++
+					expires = env.clock.Now().Add(validFor).Unix()
+				}
+				e, err := es.Read(rt.EntityId)
+				if err != nil {
+					writeError(w, err)
+					return
+				}
+				if !e.IsActive() {
+					http.Error(w, `entity is no longer active`, http.StatusGone)
+					return
+				}
+				s, _ := env.sessionStore.Get(r, env.sessionName)
+				s.Values = map[interface{}]interface{}{
+					_USER_ID: rt.UserId,
+					_ENTITY_ID: rt.EntityId,
+					_ENTITY: e,
+					_RESUME_GENERATION: rt.Generation,
+				}
+				if err = sessions.Save(r, w); err != nil {
+					writeError(w, err)
+					return
+				}
+				rt.Expires = expires
+				writeJson(w, &oak.Json{_ID: rt.EntityId, _VERSION: e.GetVersion(), _RESUME_TOKEN: rt.sign(env.authKey)})
+			})
+		}})
+		c.middleware = append(c.middleware, func(env *routeEnv, path string, next http.Handler) http.Handler {
+			if !containsString([]string{_CREATE, _JOIN, _POLL, _ACT, _LEAVE, _MATCH}, path) {
+				return next
+			}
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if invalidateOldSession {
+					if err := clearResumedSession(env, w, r); err != nil {
+						writeError(w, err)
+						return
+					}
+				}
+				if path != _CREATE && path != _JOIN && path != _MATCH {
+					next.ServeHTTP(w, r)
+					return
+				}
+				bw := &bufferedWriter{header: http.Header{}, status: http.StatusOK}
+				next.ServeHTTP(bw, r)
+				if bw.status == http.StatusOK {
+					if s, err := env.sessionStore.Get(r, env.sessionName); err == nil {
+						userId, _ := s.Values[_USER_ID].(string)
+						entityId, _ := s.Values[_ENTITY_ID].(string)
+						generation, _ := s.Values[_RESUME_GENERATION].(int)
+						respJson := oak.Json{}
+						if userId != `` && entityId != `` && json.Unmarshal(bw.body.Bytes(), &respJson) == nil {
+							respJson[_RESUME_TOKEN] = (&resumeToken{entityId, userId, generation, env.clock.Now().Add(validFor).Unix()}).sign(env.authKey)
+							if d, err := json.Marshal(respJson); err == nil {
+								bw.body.Reset()
+								bw.body.Write(d)
+							}
+						}
+					}
+				}
+				bw.flush(w)
+			})
+		})
+	}
+}
+
+func clearResumedSession(env *routeEnv, w http.ResponseWriter, r *http.Request) error {
+	s, err := env.sessionStore.Get(r, env.sessionName)
+	if err != nil || s == nil {
+		return nil
+	}
+	userId, _ := s.Values[_USER_ID].(string)
+	entityId, _ := s.Values[_ENTITY_ID].(string)
+	if userId == `` || entityId == `` {
+		return nil
+	}
+	es, ok := env.entityStoreFactory(r).(*entityStore)
+	if !ok {
+		return nil
+	}
+	current, err := es.resumeGeneration(entityId, userId)
+	if err != nil {
+		return err
+	}
+	if generation, _ := s.Values[_RESUME_GENERATION].(int); generation < current {
+		s.Values = map[interface{}]interface{}{}
+		return sessions.Save(r, w)
+	}
+	return nil
+}
+
+type resumeToken struct{
+	EntityId	string	`json:"e"`
+	UserId		string	`json:"u"`
+	Generation	int		`json:"g"`
+	Expires		int64	`json:"x"`
+}
+
+func (rt *resumeToken) sign(key []byte) string {
+	d, _ := json.Marshal(rt)
+	return base64.RawURLEncoding.EncodeToString(d) + `.` + base64.RawURLEncoding.EncodeToString(resumeMac(key, d))
+}
+
+func parseResumeToken(key []byte, token string, at time.Time) (*resumeToken, error) {
+	invalid := errors.New(`invalid resume token`)
+	parts := strings.Split(token, `.`)
+	if len(parts) != 2 {
+		return nil, invalid
+	}
+	d, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, invalid
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(mac, resumeMac(key, d)) {
+		return nil, invalid
+	}
+	rt := &resumeToken{}
+	if err = json.Unmarshal(d, rt); err != nil || rt.EntityId == `` || rt.UserId == `` {
+		return nil, invalid
+	}
+	if at.Unix() >= rt.Expires {
+		return nil, errors.New(`resume token has expired`)
+	}
+	return rt, nil
+}
+
+func resumeMac(key []byte, d []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(`joak resume`))
+	m.Write(d)
+	return m.Sum(nil)
+}
+
+type resumeRecord struct{
+	Generation	int	`datastore:",noindex"`
+}
+
+type bufferedWriter struct{
+	header	http.Header
+	status	int
+	body	bytes.Buffer
+}
+
+func (bw *bufferedWriter) Header() http.Header { return bw.header }
+func (bw *bufferedWriter) Write(d []byte) (int, error) { return bw.body.Write(d) }
+func (bw *bufferedWriter) WriteHeader(status int) { bw.status = status }
+
+func (bw *bufferedWriter) flush(w http.ResponseWriter) {
+	for k, v := range bw.header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(bw.status)
+	w.Write(bw.body.Bytes())
+}
+
+// Keeps keys in the session when oak replaces the session values, so long as the user and entity are unchanged.
+type stickySessionStore struct{
+	sessions.Store
+	keys	[]string
+}
+
+func (ss *stickySessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(ss, name)
+}
+
+func (ss *stickySessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	s, err := ss.Store.New(r, name)
+	if s != nil {
+		loaded, _ := gctx.Get(r, _STICKY_SESSION_KEY).(map[string]map[interface{}]interface{})
+		if loaded == nil {
+			loaded = map[string]map[interface{}]interface{}{}
+			gctx.Set(r, _STICKY_SESSION_KEY, loaded)
+		}
+		values := map[interface{}]interface{}{}
+		for k, v := range s.Values {
+			values[k] = v
+		}
+		loaded[name] = values
+	}
+	return s, err
+}
+
+func (ss *stickySessionStore) Save(r *http.Request, w http.ResponseWriter, s *sessions.Session) error {
+	loaded, _ := gctx.Get(r, _STICKY_SESSION_KEY).(map[string]map[interface{}]interface{})
+	if old, ok := loaded[s.Name()]; ok && s.Values[_ENTITY_ID] != nil && s.Values[_ENTITY_ID] == old[_ENTITY_ID] && s.Values[_USER_ID] == old[_USER_ID] {
+		for _, key := range ss.keys {
+			if _, exists := s.Values[key]; !exists {
+				if v, exists := old[key]; exists {
+					s.Values[key] = v
+				}
+			}
+		}
+	}
+	return ss.Store.Save(r, w, s)
+}
@@ -0,0 +1,132 @@
+package joak
+
+import(
+	`sync`
+	`time`
+	`testing`
+	`net/http`
+	`net/http/httptest`
+	`github.com/0xor1/oak`
+	`github.com/gorilla/mux`
+	`github.com/stretchr/testify/assert`
+)
+
+func newResumeTestServer(clock Clock, invalidateOldSession bool) (*httptest.Server, *Routes) {
+	dur, _ := time.ParseDuration(`1h`)
+	router := mux.NewRouter()
+	routes := RouteLocalTest(router, func()Entity{return &actTestEntity{}}, func(e Entity)Entity{return e}, 300, `test`, `auth`, `crypt-key-0123456789abcdefghijkl`, ``, ``, &actTestEntity{}, actTestResp, actTestResp, actTestPerformAct, dur, WithClock(clock), WithResumeTokens(time.Minute, invalidateOldSession))
+	return httptest.NewServer(router), routes
+}
+
+func Test_WithResumeTokens(t *testing.T){
+	clock := NewFakeClock(now())
+	server, _ := newResumeTestServer(clock, false)
+	defer server.Close()
+	c1, c2, c3 := newTestClient(server), newTestClient(server), newTestClient(server)
+
+	resp := c1.post(`/create`, nil)
+	id := resp[`id`].(string)
+
+	assert.NotNil(t, resp[`resumeToken`], `create should issue a resume token to the creator`)
+
+	token := c2.post(`/join`, oak.Json{`id`: id})[`resumeToken`]
+
+	assert.NotNil(t, token, `join should issue a resume token to the new user`)
+
+	clock.Advance(30 * time.Second)
+	resp = c3.post(`/resume`, oak.Json{`resumeToken`: token})
+	resumedToken := resp[`resumeToken`]
+
+	assert.Equal(t, id, resp[`id`], `resume should return the entity id`)
+	assert.NotNil(t, resumedToken, `resume should issue a fresh resume token`)
+
+	resp = c3.post(`/act`, oak.Json{`n`: 2})
+
+	assert.Equal(t, float64(2), resp[`count`], `the resumed session should be able to act`)
+
+	resp = c2.post(`/act`, oak.Json{`n`: 3})
+
+	assert.Equal(t, float64(5), resp[`count`], `the old session should still work when not invalidated`)
+
+	clock.Advance(30 * time.Second)
+	resp = c3.post(`/resume`, oak.Json{`resumeToken`: token})
+
+	assert.Nil(t, resp[`id`], `expired tokens should be rejected`)
+
+	resp = c3.post(`/resume`, oak.Json{`resumeToken`: resumedToken})
+
+	assert.Nil(t, resp[`id`], `a token issued on resume should expire with the token it was resumed from`)
+
+	resp = c3.post(`/resume`, oak.Json{`resumeToken`: token.(string) + `x`})
+
+	assert.Nil(t, resp[`id`], `tampered tokens should be rejected`)
+}
+
+func Test_WithResumeTokens_invalidateOldSession(t *testing.T){
+	server, routes := newResumeTestServer(NewFakeClock(now()), true)
+	defer server.Close()
+	c1, c2, c3 := newTestClient(server), newTestClient(server), newTestClient(server)
+
+	id := c1.post(`/create`, nil)[`id`].(string)
+	token := c2.post(`/join`, oak.Json{`id`: id})[`resumeToken`]
+	resp := c2.post(`/act`, oak.Json{`n`: 1})
+
+	assert.Equal(t, float64(1), resp[`count`], `the session should keep working across acts before a resume`)
+
+	resp = c3.post(`/resume`, oak.Json{`resumeToken`: token})
+	newToken := resp[`resumeToken`]
+
+	assert.Equal(t, id, resp[`id`], `resume should return the entity id`)
+	assert.Nil(t, c2.post(`/resume`, oak.Json{`resumeToken`: token})[`id`], `a used token should be rejected`)
+
+	c2.post(`/act`, oak.Json{`n`: 2})
+	resp = c3.post(`/act`, oak.Json{`n`: 3})
+
+	assert.Equal(t, float64(4), resp[`count`], `the old session should have been cleared and the resumed session should still work`)
+
+	resp = c1.post(`/resume`, oak.Json{`resumeToken`: newToken})
+	c3.post(`/act`, oak.Json{`n`: 5})
+	r, _ := http.NewRequest(`GET`, `/`, nil)
+	e, _ := routes.EntityStore(r).Read(id)
+
+	assert.Equal(t, id, resp[`id`], `the token issued on resume should be usable`)
+	assert.Equal(t, 4, e.(*actTestEntity).Count, `a session should be invalidated by each resume`)
+}
+
+func Test_WithResumeTokens_concurrentResume(t *testing.T){
+	server, _ := newResumeTestServer(NewFakeClock(now()), true)
+	defer server.Close()
+	c1, c2 := newTestClient(server), newTestClient(server)
+
+	id := c1.post(`/create`, nil)[`id`].(string)
+	token := c2.post(`/join`, oak.Json{`id`: id})[`resumeToken`]
+	resumed := make(chan bool, 10)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resumed <- newTestClient(server).post(`/resume`, oak.Json{`resumeToken`: token})[`id`] == id
+		}()
+	}
+	wg.Wait()
+	close(resumed)
+	count := 0
+	for ok := range resumed {
+		if ok {
+			count++
+		}
+	}
+
+	assert.Equal(t, 1, count, `a token should only be usable once when used concurrently`)
+}
+
+func Test_WithResumeTokens_postOnly(t *testing.T){
+	router := newCsrfTestRouter(WithPostOnly(), WithResumeTokens(time.Minute, false))
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest(`GET`, `/resume`, nil)
+	router.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code, `GET should not be allowed on resume`)
+}
@@ -0,0 +1,124 @@
+package joak
+
+import(
+	`time`
+	`bytes`
+	`strings`
+	`net/http`
+	`io/ioutil`
+	`math/rand`
+	`sync/atomic`
+	`encoding/gob`
+	`golang.org/x/net/context`
+	`github.com/gorilla/sessions`
+	gctx `github.com/gorilla/context`
+)
+
+// The nth retry of an /act waits a random time between half and all of BaseDelay * 2^n, capped at MaxDelay when it is positive.
+type ActRetry struct{
+	MaxRetries	int
+	BaseDelay	time.Duration
+	MaxDelay	time.Duration
+}
+
+// Counts of /act requests that conflicted with a concurrent update, read them with Routes.ActRetryStats.
+type ActRetryStats struct{
+	Conflicts	uint64
+	Retries		uint64
+	Exhausted	uint64
+}
+
+// Retries an /act that fails because another request updated the entity first, oak then re-reads the entity and re-applies performAct.
+// Each retry starts from the session the act arrived with, as oak also applies performAct to the entity cached in the session.
+func WithActRetry(retry ActRetry) Option {
+	return func(c *config) {
+		c.middleware = append(c.middleware, func(env *routeEnv, path string, next http.Handler) http.Handler {
+			if path != _ACT {
+				return next
+			}
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var body []byte
+				if r.Body != nil {
+					body, _ = ioutil.ReadAll(r.Body)
+				}
+				ctx, _ := gctx.Get(r, _REQUEST_CONTEXT_KEY).(context.Context)
+				s, snapshot := snapshotSession(env, r)
+				for attempt := 0;; attempt++ {
+					if attempt > 0 {
+						s.Values, _ = restoreSession(snapshot)
+					}
+					r.Body = ioutil.NopCloser(bytes.NewReader(body))
+					bw := &bufferedWriter{header: http.Header{}, status: http.StatusOK}
+					next.ServeHTTP(bw, r)
+					if !isConflictResp(bw) {
+						bw.flush(w)
+						return
+					}
+					if attempt == 0 {
+						atomic.AddUint64(&c.actRetryStats.Conflicts, 1)
+					}
+					if attempt == retry.MaxRetries || snapshot == nil || !retry.wait(ctx, attempt) {
+						atomic.AddUint64(&c.actRetryStats.Exhausted, 1)
+						bw.flush(w)
+						return
+					}
+					atomic.AddUint64(&c.actRetryStats.Retries, 1)
+				}
+			})
+		})
+	}
+}
+
+func (rs *Routes) ActRetryStats() ActRetryStats {
+	return ActRetryStats{
+		Conflicts: atomic.LoadUint64(&rs.actRetryStats.Conflicts),
+		Retries: atomic.LoadUint64(&rs.actRetryStats.Retries),
+		Exhausted: atomic.LoadUint64(&rs.actRetryStats.Exhausted),
+	}
+}
+
+// Returns false when ctx is done before the delay has passed.
+func (retry ActRetry) wait(ctx context.Context, attempt int) bool {
+	delay := retry.BaseDelay << uint(attempt)
+	if delay <= 0 || (retry.MaxDelay > 0 && delay > retry.MaxDelay) {
+		delay = retry.MaxDelay
+	}
+	if delay > 1 {
+		delay = delay / 2 + time.Duration(rand.Int63n(int64(delay / 2)))
+	}
+	if ctx == nil {
+		time.Sleep(delay)
+		return true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Encodes the session values the way the session cookie does, the snapshot is nil when there is no session to restore.
+func snapshotSession(env *routeEnv, r *http.Request) (*sessions.Session, []byte) {
+	s, err := env.sessionStore.Get(r, env.sessionName)
+	if err != nil || s == nil {
+		return nil, nil
+	}
+	buf := &bytes.Buffer{}
+	if gob.NewEncoder(buf).Encode(s.Values) != nil {
+		return nil, nil
+	}
+	return s, buf.Bytes()
+}
+
+func restoreSession(snapshot []byte) (map[interface{}]interface{}, error) {
+	values := map[interface{}]interface{}{}
+	err := gob.NewDecoder(bytes.NewReader(snapshot)).Decode(&values)
+	return values, err
+}
+
+func isConflictResp(bw *bufferedWriter) bool {
+	return bw.status == http.StatusInternalServerError && strings.HasPrefix(bw.body.String(), `nonsequential update for entity with id "`)
+}
@@ -0,0 +1,91 @@
+package joak
+
+import(
+	`time`
+	`errors`
+	`testing`
+	`net/http`
+	`net/http/httptest`
+	`github.com/0xor1/oak`
+	`github.com/gorilla/mux`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_WithActRetry(t *testing.T){
+	conflicts := 0
+	withConflicts := func(c *config) {
+		c.wrappers = append(c.wrappers, func(r *http.Request, es oak.EntityStore) oak.EntityStore {
+			return &conflictingStore{es, &conflicts}
+		})
+	}
+	router := mux.NewRouter()
+	routes := RouteLocalTest(router, func()Entity{return &actTestEntity{}}, func(e Entity)Entity{return e}, 300, `test`, `auth`, `crypt-key-0123456789abcdefghijkl`, ``, ``, &actTestEntity{}, actTestResp, actTestResp, actTestPerformAct, time.Hour, withConflicts, WithActRetry(ActRetry{3, time.Millisecond, 4 * time.Millisecond}))
+	server := httptest.NewServer(router)
+	defer server.Close()
+	c := newTestClient(server)
+
+	id := c.post(`/create`, nil)[`id`].(string)
+	conflicts = 2
+	resp := c.post(`/act`, oak.Json{`n`: 2})
+
+	assert.Equal(t, float64(2), resp[`count`], `an act should succeed once the conflicts stop and be applied once`)
+	assert.Equal(t, ActRetryStats{1, 2, 0}, routes.ActRetryStats(), `the conflict and its retries should be counted`)
+
+	conflicts = 5
+	resp = c.post(`/act`, oak.Json{`n`: 3})
+	r, _ := http.NewRequest(`GET`, `/`, nil)
+	e, _ := routes.EntityStore(r).Read(id)
+
+	assert.Nil(t, resp[`count`], `an act should fail once the retries run out`)
+	assert.Equal(t, 2, e.(*actTestEntity).Count, `a failed act should not be applied`)
+	assert.Equal(t, ActRetryStats{2, 5, 1}, routes.ActRetryStats(), `acts that run out of retries should be counted`)
+}
+
+func Test_WithActRetry_nonAdditiveAct(t *testing.T){
+	conflicts := 0
+	withConflicts := func(c *config) {
+		c.wrappers = append(c.wrappers, func(r *http.Request, es oak.EntityStore) oak.EntityStore {
+			return &conflictingStore{es, &conflicts}
+		})
+	}
+	// moves the count from one value to another, so applying it twice fails
+	performAct := func(json oak.Json, userId string, e oak.Entity) error {
+		from, _ := json[`from`].(float64)
+		to, _ := json[`to`].(float64)
+		if e.(*actTestEntity).Count != int(from) {
+			return errors.New(`count has moved on`)
+		}
+		e.(*actTestEntity).Count = int(to)
+		return nil
+	}
+	router := mux.NewRouter()
+	routes := RouteLocalTest(router, func()Entity{return &actTestEntity{}}, func(e Entity)Entity{return e}, 300, `test`, `auth`, `crypt-key-0123456789abcdefghijkl`, ``, ``, &actTestEntity{}, actTestResp, actTestResp, performAct, time.Hour, withConflicts, WithActRetry(ActRetry{3, time.Millisecond, 4 * time.Millisecond}))
+	server := httptest.NewServer(router)
+	defer server.Close()
+	c := newTestClient(server)
+
+	c.post(`/create`, nil)
+	conflicts = 2
+	resp := c.post(`/act`, oak.Json{`from`: 0, `to`: 5})
+
+	assert.Equal(t, float64(5), resp[`count`], `each retry should apply the act to the session entity the request arrived with`)
+	assert.Equal(t, ActRetryStats{1, 2, 0}, routes.ActRetryStats(), `the conflict and its retries should be counted`)
+
+	resp = c.post(`/act`, oak.Json{`from`: 5, `to`: 7})
+
+	assert.Equal(t, float64(7), resp[`count`], `the session should hold the entity written by the successful retry`)
+}
+
+// Fails the next *conflicts updates as if another request had updated the entity first.
+type conflictingStore struct{
+	oak.EntityStore
+	conflicts	*int
+}
+
+func (cs *conflictingStore) Update(entityId string, e oak.Entity) error {
+	if *cs.conflicts > 0 {
+		*cs.conflicts--
+		return &nonsequentialUpdateError{entityId}
+	}
+	return cs.EntityStore.Update(entityId, e)
+}
@@ -0,0 +1,56 @@
+package joak
+
+import(
+	`errors`
+	`strconv`
+	`net/http`
+)
+
+type SchemaVersioned interface{
+	GetSchemaVersion() int
+	SetSchemaVersion(int)
+}
+
+// Upgrades an entity from one schema version to the next.
+type Migration func(e Entity) error
+
+// migrations[n] upgrades SchemaVersioned entities from schema version n to n+1, the current schema version is len(migrations).
+func WithSchemaMigrations(migrations ...Migration) Option {
+	return func(c *config) {
+		c.migrations = migrations
+		c.middleware = append(c.middleware, func(env *routeEnv, path string, next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if e := env.getSessionEntity(r); e != nil {
+					if err := migrateEntity(e, migrations); err != nil {
+						writeError(w, err)
+						return
+					}
+				}
+				next.ServeHTTP(w, r)
+			})
+		})
+	}
+}
+
+func migrateEntity(e Entity, migrations []Migration) error {
+	sv, ok := e.(SchemaVersioned)
+	if !ok || len(migrations) == 0 {
+		return nil
+	}
+	if sv.GetSchemaVersion() > len(migrations) {
+		return errors.New(`entity schema version ` + strconv.Itoa(sv.GetSchemaVersion()) + ` is newer than the current schema version ` + strconv.Itoa(len(migrations)))
+	}
+	for v := sv.GetSchemaVersion(); v < len(migrations); v++ {
+		if err := migrations[v](e); err != nil {
+			return errors.New(`entity schema migration from version ` + strconv.Itoa(v) + ` failed: ` + err.Error())
+		}
+		sv.SetSchemaVersion(v + 1)
+	}
+	return nil
+}
+
+func stampSchemaVersion(e Entity, migrations []Migration) {
+	if sv, ok := e.(SchemaVersioned); ok && len(migrations) > 0 {
+		sv.SetSchemaVersion(len(migrations))
+	}
+}
@@ -0,0 +1,106 @@
+package joak
+
+import(
+	`time`
+	`errors`
+	`testing`
+	`net/http`
+	`net/http/httptest`
+	`github.com/0xor1/oak`
+	`github.com/gorilla/mux`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_migrateEntity(t *testing.T){
+	e := &schemaTestEntity{}
+	migrations := []Migration{
+		func(e Entity) error { e.(*schemaTestEntity).Lives = 3; return nil },
+		func(e Entity) error { e.(*schemaTestEntity).Lives *= 2; return nil },
+	}
+
+	err := migrateEntity(e, migrations)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, 6, e.Lives, `migrations should have run in order`)
+	assert.Equal(t, 2, e.SchemaVersion, `schema version should be current`)
+
+	err = migrateEntity(e, migrations)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, 6, e.Lives, `migrations should not run again on a current entity`)
+
+	err = migrateEntity(e, migrations[:1])
+
+	assert.Equal(t, `entity schema version 2 is newer than the current schema version 1`, err.Error(), `err should have appropriate message`)
+
+	err = migrateEntity(&schemaTestEntity{}, []Migration{func(e Entity) error { return errors.New(`test`) }})
+
+	assert.Equal(t, `entity schema migration from version 0 failed: test`, err.Error(), `err should have appropriate message`)
+}
+
+func Test_MemoryStore_WithSchemaMigrations(t *testing.T){
+	dur, _ := time.ParseDuration(`1m`)
+	ef := func()Entity{return &schemaTestEntity{}}
+	ei := func(e Entity)Entity{return e}
+	cfg := newConfig(nil)
+	s := newMemoryStore(ef, ei, dur, cfg).(*entityStore)
+
+	id, e, _ := s.Create()
+
+	assert.Equal(t, 0, e.(*schemaTestEntity).SchemaVersion, `schema version should be 0 without migrations`)
+
+	s.migrations = []Migration{func(e Entity) error { e.(*schemaTestEntity).Lives = 3; return nil }}
+	e, err := s.Read(id)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, 3, e.(*schemaTestEntity).Lives, `old entities should be migrated on read`)
+	assert.Equal(t, 1, e.(*schemaTestEntity).SchemaVersion, `schema version should be current`)
+
+	cfg.migrations = s.migrations
+	id, e, _ = s.Create()
+
+	assert.Equal(t, 1, e.(*schemaTestEntity).SchemaVersion, `new entities should be created at the current schema version`)
+	assert.Equal(t, 0, e.(*schemaTestEntity).Lives, `new entities should not be migrated`)
+}
+
+func Test_WithSchemaMigrations_session(t *testing.T){
+	dur, _ := time.ParseDuration(`1m`)
+	ef := func()Entity{return &schemaTestEntity{}}
+	ei := func(e Entity)Entity{return e}
+	livesSeen := []int{}
+	performAct := func(json oak.Json, userId string, e oak.Entity) error {
+		livesSeen = append(livesSeen, e.(*schemaTestEntity).Lives)
+		return nil
+	}
+	getResp := func(userId string, e oak.Entity) oak.Json { return oak.Json{} }
+
+	oldRouter := mux.NewRouter()
+	RouteLocalTest(oldRouter, ef, ei, 300, `test`, `auth`, `crypt-key-0123456789abcdefghijkl`, ``, ``, &schemaTestEntity{}, getResp, getResp, performAct, dur)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest(`POST`, `/create`, nil)
+	oldRouter.ServeHTTP(w, r)
+	cookie := w.HeaderMap.Get(`Set-Cookie`)
+
+	newRouter := mux.NewRouter()
+	RouteLocalTest(newRouter, ef, ei, 300, `test`, `auth`, `crypt-key-0123456789abcdefghijkl`, ``, ``, &schemaTestEntity{}, getResp, getResp, performAct, dur, WithSchemaMigrations(func(e Entity) error { e.(*schemaTestEntity).Lives = 3; return nil }))
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest(`POST`, `/act`, nil)
+	r.Header.Set(`Cookie`, cookie)
+	newRouter.ServeHTTP(w, r)
+
+	assert.Equal(t, []int{3}, livesSeen, `the session entity should have been migrated before reaching oak`)
+}
+
+type schemaTestEntity struct{
+	testEntity
+	SchemaVersion	int
+	Lives			int
+}
+
+func (e *schemaTestEntity) GetSchemaVersion() int {
+	return e.SchemaVersion
+}
+
+func (e *schemaTestEntity) SetSchemaVersion(v int) {
+	e.SchemaVersion = v
+}
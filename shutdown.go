@@ -0,0 +1,67 @@
+package joak
+
+import(
+	`sync`
+	`golang.org/x/net/context`
+)
+
+// Called by Shutdown once background work has finished, to write out state such as metrics buffered outside of joak.
+func WithFlush(flush func(ctx context.Context) error) Option {
+	return func(c *config) {
+		c.flushers = append(c.flushers, flush)
+	}
+}
+
+// Stops starting background clear outs, along with the OnExpire hooks they call, waits for those already running until ctx is done
+// and then calls the WithFlush functions. Requests are still served after Shutdown, entities just stop being swept. When ctx is done
+// before the background work finishes the flush functions are still called and ctx.Err() is returned.
+func (rs *Routes) Shutdown(ctx context.Context) error {
+	rs.background.stop()
+	done := make(chan struct{})
+	go func() {
+		rs.background.wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	for _, flush := range rs.flushers {
+		if ferr := flush(ctx); ferr != nil && err == nil {
+			err = ferr
+		}
+	}
+	return err
+}
+
+type backgroundTasks struct{
+	mtx		sync.Mutex
+	wg		sync.WaitGroup
+	stopped	bool
+}
+
+// Runs task in a new goroutine unless the tasks have been stopped.
+func (bt *backgroundTasks) start(task func()) {
+	bt.mtx.Lock()
+	defer bt.mtx.Unlock()
+	if bt.stopped {
+		return
+	}
+	bt.wg.Add(1)
+	go func() {
+		defer bt.wg.Done()
+		task()
+	}()
+}
+
+func (bt *backgroundTasks) stop() {
+	bt.mtx.Lock()
+	bt.stopped = true
+	bt.mtx.Unlock()
+}
+
+func (bt *backgroundTasks) wait() {
+	bt.wg.Wait()
+}
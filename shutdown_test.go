@@ -0,0 +1,47 @@
+package joak
+
+import(
+	`time`
+	`testing`
+	`net/http`
+	`github.com/0xor1/oak`
+	`golang.org/x/net/context`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_Routes_Shutdown(t *testing.T){
+	flushes := 0
+	cfg := newConfig([]Option{WithFlush(func(ctx context.Context) error {
+		flushes++
+		return nil
+	})})
+	s := newMemoryStore(func()Entity{return &testEntity{}}, func(e Entity)Entity{return e}, time.Hour, cfg).(*entityStore)
+	release := make(chan struct{})
+	sweeps := 0
+	s.clearOut = func() {
+		<-release
+		sweeps++
+	}
+	rs := &Routes{func(r *http.Request) oak.EntityStore { return s }, s.withContext, cfg.background, cfg.flushers, &cfg.actRetryStats}
+
+	s.Create()
+	ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Millisecond)
+	defer cancel()
+	err := rs.Shutdown(ctx)
+
+	assert.Equal(t, context.DeadlineExceeded, err, `Shutdown should return when ctx is done before clear outs finish`)
+	assert.Equal(t, 1, flushes, `flush functions should be called even when ctx is done`)
+
+	close(release)
+	err = rs.Shutdown(context.Background())
+
+	assert.Nil(t, err, `Shutdown should succeed once clear outs finish`)
+	assert.Equal(t, 1, sweeps, `Shutdown should wait for running clear outs`)
+	assert.Equal(t, 2, flushes, `flush functions should be called on every Shutdown`)
+
+	_, _, err = s.Create()
+	rs.Shutdown(context.Background())
+
+	assert.Nil(t, err, `stores should still work after Shutdown`)
+	assert.Equal(t, 1, sweeps, `no clear outs should start after Shutdown`)
+}
@@ -0,0 +1,47 @@
+package joak
+
+import(
+	`errors`
+	`net/http`
+	`encoding/json`
+	`github.com/0xor1/oak`
+)
+
+const(
+	_SPECTATE	= `/spectate`
+)
+
+type GetSpectatorResp func(e oak.Entity) oak.Json
+
+// Adds a /spectate route which takes {"id", "v"} like /poll but never registers a user, writes the entity or touches the session,
+// "v" may be omitted on the first request to always get a response.
+func WithSpectators(getSpectatorResp GetSpectatorResp) Option {
+	return func(c *config) {
+		c.routes = append(c.routes, extraRoute{_SPECTATE, func(env *routeEnv) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				req := struct{
+					Id	*string		`json:"id"`
+					V	*float64	`json:"v"`
+				}{}
+				if r.Body != nil {
+					json.NewDecoder(r.Body).Decode(&req)
+				}
+				if req.Id == nil {
+					writeError(w, errors.New(_ID + ` value must be included in request`))
+					return
+				}
+				e, err := env.entityStoreFactory(r).Read(*req.Id)
+				if err != nil {
+					writeError(w, err)
+					return
+				}
+				if req.V != nil && int(*req.V) == e.GetVersion() {
+					return
+				}
+				respJson := getSpectatorResp(e)
+				respJson[_VERSION] = e.GetVersion()
+				writeJson(w, &respJson)
+			})
+		}})
+	}
+}
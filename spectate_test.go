@@ -0,0 +1,43 @@
+package joak
+
+import(
+	`time`
+	`testing`
+	`net/http`
+	`net/http/httptest`
+	`github.com/0xor1/oak`
+	`github.com/gorilla/mux`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_WithSpectators(t *testing.T){
+	dur, _ := time.ParseDuration(`1m`)
+	router := mux.NewRouter()
+	getSpectatorResp := func(e oak.Entity) oak.Json { return oak.Json{`spectating`: true, `players`: e.(*actTestEntity).Players} }
+	routes := RouteLocalTest(router, func()Entity{return &actTestEntity{}}, func(e Entity)Entity{return e}, 300, `test`, `auth`, `crypt-key-0123456789abcdefghijkl`, ``, ``, &actTestEntity{}, actTestResp, actTestResp, actTestPerformAct, dur, WithSpectators(getSpectatorResp))
+	server := httptest.NewServer(router)
+	defer server.Close()
+	player, spectator := newTestClient(server), newTestClient(server)
+
+	id := player.post(`/create`, nil)[`id`].(string)
+	resp := spectator.post(`/spectate`, oak.Json{`id`: id})
+
+	assert.Equal(t, true, resp[`spectating`], `spectator response should come from GetSpectatorResp`)
+	assert.Equal(t, float64(0), resp[`players`], `spectating should not register a new user`)
+	assert.Equal(t, float64(0), resp[`v`], `spectating should not write the entity`)
+
+	resp = spectator.post(`/spectate`, oak.Json{`id`: id, `v`: 0})
+
+	assert.Equal(t, 0, len(resp), `an unchanged entity should get an empty response`)
+
+	player.post(`/act`, oak.Json{`n`: 2})
+	resp = spectator.post(`/spectate`, oak.Json{`id`: id, `v`: 0})
+
+	assert.Equal(t, float64(1), resp[`v`], `changes should be returned to spectators`)
+
+	resp = spectator.post(`/act`, oak.Json{`n`: 2})
+	r, _ := http.NewRequest(`GET`, `/`, nil)
+	e, _ := routes.EntityStore(r).Read(id)
+
+	assert.Equal(t, 2, e.(*actTestEntity).Count, `spectators should not have a session to act with`)
+}
@@ -0,0 +1,813 @@
+package joak
+
+import(
+	`log`
+	`math`
+	`time`
+	`errors`
+	`strconv`
+	`strings`
+	`database/sql`
+	`encoding/json`
+	`github.com/0xor1/oak`
+	`github.com/0xor1/sus`
+	`github.com/0xor1/sid`
+	`github.com/gorilla/mux`
+	`golang.org/x/net/context`
+)
+
+type SqlDialect interface{
+	Placeholder(n int) string
+	CreateTable(table string) []string
+	// Returns an insert of a value for each of columns that does nothing when a row with the same primary key exists.
+	InsertIfAbsent(table string, columns []string) string
+}
+
+var(
+	SqliteDialect SqlDialect = &sqliteDialect{}
+	PostgresDialect SqlDialect = &postgresDialect{}
+)
+
+type sqliteDialect struct{}
+
+func (d *sqliteDialect) Placeholder(n int) string {
+	return `?`
+}
+
+func (d *sqliteDialect) InsertIfAbsent(table string, columns []string) string {
+	return `INSERT OR IGNORE INTO ` + table + ` (` + strings.Join(columns, `, `) + `) VALUES (` + placeholders(d, len(columns)) + `)`
+}
+
+func (d *sqliteDialect) CreateTable(table string) []string {
+	return []string{
+		`CREATE TABLE IF NOT EXISTS ` + table + ` (id TEXT NOT NULL, kind TEXT NOT NULL, version INTEGER NOT NULL, delete_after INTEGER NOT NULL, payload BLOB NOT NULL, PRIMARY KEY (kind, id))`,
+		`CREATE INDEX IF NOT EXISTS ` + table + `_delete_after ON ` + table + ` (kind, delete_after)`,
+		`CREATE TABLE IF NOT EXISTS ` + table + `_log (kind TEXT NOT NULL, entity_id TEXT NOT NULL, version INTEGER NOT NULL, user_id TEXT NOT NULL, act BLOB, snapshot BLOB, at INTEGER NOT NULL, PRIMARY KEY (kind, entity_id, version))`,
+		`CREATE TABLE IF NOT EXISTS ` + table + `_history (kind TEXT NOT NULL, entity_id TEXT NOT NULL, version INTEGER NOT NULL, payload BLOB NOT NULL, PRIMARY KEY (kind, entity_id, version))`,
+		`CREATE TABLE IF NOT EXISTS ` + table + `_resume (kind TEXT NOT NULL, entity_id TEXT NOT NULL, user_id TEXT NOT NULL, generation INTEGER NOT NULL, PRIMARY KEY (kind, entity_id, user_id))`,
+		`CREATE TABLE IF NOT EXISTS ` + table + `_open (kind TEXT NOT NULL, entity_id TEXT NOT NULL, PRIMARY KEY (kind, entity_id))`,
+		`CREATE TABLE IF NOT EXISTS ` + table + `_lobby (kind TEXT NOT NULL, entity_id TEXT NOT NULL, created_at INTEGER NOT NULL, created_by TEXT NOT NULL, players INTEGER NOT NULL, summary BLOB, delete_after INTEGER NOT NULL, PRIMARY KEY (kind, entity_id))`,
+		`CREATE INDEX IF NOT EXISTS ` + table + `_lobby_created_at ON ` + table + `_lobby (kind, created_at, entity_id)`,
+		`CREATE TABLE IF NOT EXISTS ` + table + `_lifetime (kind TEXT NOT NULL, entity_id TEXT NOT NULL, created_at INTEGER NOT NULL, idle_until INTEGER NOT NULL, PRIMARY KEY (kind, entity_id))`,
+		`CREATE INDEX IF NOT EXISTS ` + table + `_lifetime_created_at ON ` + table + `_lifetime (kind, created_at)`,
+		`CREATE TABLE IF NOT EXISTS ` + table + `_act_resp (kind TEXT NOT NULL, entity_id TEXT NOT NULL, user_id TEXT NOT NULL, idempotency_key TEXT NOT NULL, resp BLOB NOT NULL, delete_after INTEGER NOT NULL, PRIMARY KEY (kind, entity_id, user_id, idempotency_key))`,
+		`CREATE INDEX IF NOT EXISTS ` + table + `_act_resp_delete_after ON ` + table + `_act_resp (kind, delete_after)`,
+	}
+}
+
+type postgresDialect struct{}
+
+func (d *postgresDialect) Placeholder(n int) string {
+	return `$` + strconv.Itoa(n)
+}
+
+func (d *postgresDialect) InsertIfAbsent(table string, columns []string) string {
+	return `INSERT INTO ` + table + ` (` + strings.Join(columns, `, `) + `) VALUES (` + placeholders(d, len(columns)) + `) ON CONFLICT DO NOTHING`
+}
+
+func (d *postgresDialect) CreateTable(table string) []string {
+	return []string{
+		`CREATE TABLE IF NOT EXISTS ` + table + ` (id TEXT NOT NULL, kind TEXT NOT NULL, version BIGINT NOT NULL, delete_after BIGINT NOT NULL, payload BYTEA NOT NULL, PRIMARY KEY (kind, id))`,
+		`CREATE INDEX IF NOT EXISTS ` + table + `_delete_after ON ` + table + ` (kind, delete_after)`,
+		`CREATE TABLE IF NOT EXISTS ` + table + `_log (kind TEXT NOT NULL, entity_id TEXT NOT NULL, version BIGINT NOT NULL, user_id TEXT NOT NULL, act BYTEA, snapshot BYTEA, at BIGINT NOT NULL, PRIMARY KEY (kind, entity_id, version))`,
+		`CREATE TABLE IF NOT EXISTS ` + table + `_history (kind TEXT NOT NULL, entity_id TEXT NOT NULL, version BIGINT NOT NULL, payload BYTEA NOT NULL, PRIMARY KEY (kind, entity_id, version))`,
+		`CREATE TABLE IF NOT EXISTS ` + table + `_resume (kind TEXT NOT NULL, entity_id TEXT NOT NULL, user_id TEXT NOT NULL, generation BIGINT NOT NULL, PRIMARY KEY (kind, entity_id, user_id))`,
+		`CREATE TABLE IF NOT EXISTS ` + table + `_open (kind TEXT NOT NULL, entity_id TEXT NOT NULL, PRIMARY KEY (kind, entity_id))`,
+		`CREATE TABLE IF NOT EXISTS ` + table + `_lobby (kind TEXT NOT NULL, entity_id TEXT NOT NULL, created_at BIGINT NOT NULL, created_by TEXT NOT NULL, players BIGINT NOT NULL, summary BYTEA, delete_after BIGINT NOT NULL, PRIMARY KEY (kind, entity_id))`,
+		`CREATE INDEX IF NOT EXISTS ` + table + `_lobby_created_at ON ` + table + `_lobby (kind, created_at, entity_id)`,
+		`CREATE TABLE IF NOT EXISTS ` + table + `_lifetime (kind TEXT NOT NULL, entity_id TEXT NOT NULL, created_at BIGINT NOT NULL, idle_until BIGINT NOT NULL, PRIMARY KEY (kind, entity_id))`,
+		`CREATE INDEX IF NOT EXISTS ` + table + `_lifetime_created_at ON ` + table + `_lifetime (kind, created_at)`,
+		`CREATE TABLE IF NOT EXISTS ` + table + `_act_resp (kind TEXT NOT NULL, entity_id TEXT NOT NULL, user_id TEXT NOT NULL, idempotency_key TEXT NOT NULL, resp BYTEA NOT NULL, delete_after BIGINT NOT NULL, PRIMARY KEY (kind, entity_id, user_id, idempotency_key))`,
+		`CREATE INDEX IF NOT EXISTS ` + table + `_act_resp_delete_after ON ` + table + `_act_resp (kind, delete_after)`,
+	}
+}
+
+func newSqlStore(db *sql.DB, ctx context.Context, dialect SqlDialect, table string, kind string, ef EntityFactory, ei EntityInitializer, deleteAfter time.Duration, clearOutAfter time.Duration, cfg *config) oak.EntityStore {
+	deleteAfter = cfg.slidingDeleteAfter(deleteAfter)
+	q := newSqlQueries(dialect, table)
+
+	// entities are only loaded when OnExpire needs to see them, each one is then deleted at the version it was loaded at
+	expire := func(at time.Time) error {
+		if cfg.hooks.OnExpire == nil {
+			if _, err := db.Exec(q.deleteExpired, kind, at.UnixNano()); err != nil {
+				return err
+			}
+			if cfg.maxLifetime > 0 {
+				if _, err := db.Exec(q.deleteOverLifetime, kind, kind, at.Add(-cfg.maxLifetime).UnixNano()); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		createdBefore := int64(math.MinInt64)
+		if cfg.maxLifetime > 0 {
+			createdBefore = at.Add(-cfg.maxLifetime).UnixNano()
+		}
+		rows, err := db.Query(q.selectExpired, kind, at.UnixNano(), kind, createdBefore)
+		if err != nil {
+			return err
+		}
+		ids, versions, payloads := []string{}, []int{}, [][]byte{}
+		for rows.Next() {
+			var id string
+			var version int
+			var payload []byte
+			if err = rows.Scan(&id, &version, &payload); err != nil {
+				rows.Close()
+				return err
+			}
+			ids, versions, payloads = append(ids, id), append(versions, version), append(payloads, payload)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return err
+		}
+		for i, id := range ids {
+			e := ef()
+			if json.Unmarshal(payloads[i], e) == nil && migrateEntity(e, cfg.migrations) == nil {
+				cfg.hooks.run(`OnExpire`, cfg.hooks.OnExpire, id, e)
+			}
+			if _, err = db.Exec(q.deleteVersion, id, kind, versions[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// the sweep stops at the first failed statement, whatever it left behind is picked up by the next one
+	sweep := func(at time.Time) error {
+		if err := expire(at); err != nil {
+			return err
+		}
+		if _, err := db.Exec(q.deleteExpiredActResps, kind, at.UnixNano()); err != nil {
+			return err
+		}
+		for _, orphaned := range []string{q.deleteOrphanedLogs, q.deleteOrphanedHistory, q.deleteOrphanedResume, q.deleteOrphanedOpen, q.deleteOrphanedLobby, q.deleteOrphanedLifetime, q.deleteOrphanedActResps} {
+			if _, err := db.Exec(orphaned, kind, kind); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	clearOut := newClearOut(table + `/` + kind, clearOutAfter, cfg, func() {
+		if err := sweep(cfg.clock.Now()); err != nil {
+			log.Printf(`joak: clear out of kind %q in table %q failed: %s`, kind, table, err)
+		}
+	})
+
+	cdb := &contextDB{db, ctx}
+
+	list := func(at time.Time) (ids []string, deleteAfters []time.Time, err error) {
+		rows, err := cdb.Query(q.selectLive, kind, at.UnixNano())
+		if err != nil {
+			return nil, nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id string
+			var deleteAfter int64
+			if err = rows.Scan(&id, &deleteAfter); err != nil {
+				return nil, nil, err
+			}
+			ids = append(ids, id)
+			deleteAfters = append(deleteAfters, time.Unix(0, deleteAfter).UTC())
+		}
+		return ids, deleteAfters, rows.Err()
+	}
+
+	put := func(id string, e Entity, deleteAfter time.Time) error {
+		payload, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		tx, err := cdb.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(q.delete, id, kind); err == nil {
+			_, err = tx.Exec(q.insert, id, kind, e.GetVersion(), deleteAfter.UnixNano(), payload)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	}
+
+	appendLog := func(entries []*ActionLogEntry) error {
+		tx, err := cdb.Begin()
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			var act []byte
+			if entry.Act != nil {
+				if act, err = json.Marshal(entry.Act); err != nil {
+					break
+				}
+			}
+			if _, err = tx.Exec(q.insertLog, kind, entry.EntityId, entry.Version, entry.UserId, act, []byte(entry.Snapshot), entry.At.UnixNano()); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	}
+
+	readLog := func(entityId string) (entries []*ActionLogEntry, err error) {
+		rows, err := cdb.Query(q.selectLog, kind, entityId)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			entry := &ActionLogEntry{EntityId: entityId}
+			var act, snapshot []byte
+			var at int64
+			if err = rows.Scan(&entry.Version, &entry.UserId, &act, &snapshot, &at); err != nil {
+				return nil, err
+			}
+			if len(act) > 0 {
+				if err = json.Unmarshal(act, &entry.Act); err != nil {
+					return nil, err
+				}
+			}
+			if len(snapshot) > 0 {
+				entry.Snapshot = snapshot
+			}
+			entry.At = time.Unix(0, at).UTC()
+			entries = append(entries, entry)
+		}
+		return entries, rows.Err()
+	}
+
+	putHistory := func(entityId string, version int, snapshot []byte, size int) error {
+		tx, err := cdb.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(q.deleteHistoryVersion, kind, entityId, version); err == nil {
+			if _, err = tx.Exec(q.insertHistory, kind, entityId, version, snapshot); err == nil {
+				_, err = tx.Exec(q.trimHistory, kind, entityId, version - size)
+			}
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	}
+
+	readHistory := func(entityId string, version int) ([]byte, error) {
+		var payload []byte
+		err := cdb.QueryRow(q.selectHistory, kind, entityId, version).Scan(&payload)
+		if err == sql.ErrNoRows {
+			return nil, &versionNotInHistoryError{entityId, version}
+		}
+		return payload, err
+	}
+
+	resumeGeneration := func(entityId string, userId string) (int, error) {
+		var generation int
+		err := cdb.QueryRow(q.selectResume, kind, entityId, userId).Scan(&generation)
+		if err == sql.ErrNoRows {
+			return 0, nil
+		}
+		return generation, err
+	}
+
+	// the update only matches the expected generation and the insert does nothing when a row exists, so only one claim can succeed
+	claimResumeGeneration := func(entityId string, userId string, generation int) (bool, error) {
+		res, err := cdb.Exec(q.claimResume, kind, entityId, userId, generation)
+		if err == nil && generation == 0 {
+			if n, _ := res.RowsAffected(); n == 0 {
+				res, err = cdb.Exec(q.insertResume, kind, entityId, userId, 1)
+			}
+		}
+		if err != nil {
+			return false, err
+		}
+		n, err := res.RowsAffected()
+		return n == 1, err
+	}
+
+	setOpen := func(entityId string, open bool, deleteAfter time.Time) error {
+		tx, err := cdb.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(q.deleteOpen, kind, entityId); err == nil && open {
+			_, err = tx.Exec(q.insertOpen, kind, entityId)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	}
+
+	listOpen := func(at time.Time) (ids []string, err error) {
+		rows, err := cdb.Query(q.selectOpen, kind, at.UnixNano())
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id string
+			if err = rows.Scan(&id); err != nil {
+				return nil, err
+			}
+			ids = append(ids, id)
+		}
+		return ids, rows.Err()
+	}
+
+	readLifetime := func(entityId string) (*lifetimeRecord, error) {
+		var createdAt, idleUntil int64
+		err := cdb.QueryRow(q.selectLifetime, kind, entityId).Scan(&createdAt, &idleUntil)
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &lifetimeRecord{time.Unix(0, createdAt).UTC(), time.Unix(0, idleUntil).UTC()}, nil
+	}
+
+	putLobby := func(entry *LobbyEntry, deleteAfter time.Time) error {
+		summary, err := json.Marshal(entry.Summary)
+		if err != nil {
+			return err
+		}
+		tx, err := cdb.Begin()
+		if err != nil {
+			return err
+		}
+		res, err := tx.Exec(q.updateLobby, entry.CreatedBy, entry.Players, summary, deleteAfter.UnixNano(), kind, entry.Id)
+		if err == nil {
+			if n, _ := res.RowsAffected(); n == 0 {
+				_, err = tx.Exec(q.insertLobby, kind, entry.Id, entry.CreatedAt.UnixNano(), entry.CreatedBy, entry.Players, summary, deleteAfter.UnixNano())
+			}
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	}
+
+	removeLobby := func(entityId string) error {
+		_, err := cdb.Exec(q.deleteLobby, kind, entityId)
+		return err
+	}
+
+	listLobby := func(at time.Time, after lobbyCursor, limit int) (entries []*LobbyEntry, err error) {
+		createdAfter := after.nanos()
+		rows, err := cdb.Query(q.selectLobby, kind, at.UnixNano(), createdAfter, createdAfter, after.id, limit)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			entry := &LobbyEntry{}
+			var createdAt int64
+			var summary []byte
+			if err = rows.Scan(&entry.Id, &createdAt, &entry.CreatedBy, &entry.Players, &summary); err != nil {
+				return nil, err
+			}
+			entry.CreatedAt = time.Unix(0, createdAt).UTC()
+			if err = json.Unmarshal(summary, &entry.Summary); err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		}
+		return entries, rows.Err()
+	}
+
+	putLifetime := func(entityId string, r *lifetimeRecord) error {
+		tx, err := cdb.Begin()
+		if err != nil {
+			return err
+		}
+		res, err := tx.Exec(q.updateLifetime, r.IdleUntil.UnixNano(), kind, entityId)
+		if err == nil {
+			if n, _ := res.RowsAffected(); n == 0 {
+				_, err = tx.Exec(q.insertLifetime, kind, entityId, r.CreatedAt.UnixNano(), r.IdleUntil.UnixNano())
+			}
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	}
+
+	putActResp := func(entityId string, userId string, key string, resp []byte, deleteAfter time.Time) error {
+		tx, err := cdb.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(q.deleteActResp, kind, entityId, userId, key); err == nil {
+			_, err = tx.Exec(q.insertActResp, kind, entityId, userId, key, resp, deleteAfter.UnixNano())
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	}
+
+	// the insert does nothing when a live row exists, so only one request can reserve a key
+	reserveActResp := func(entityId string, userId string, key string, at time.Time, deleteAfter time.Time) (bool, []byte, error) {
+		if _, err := cdb.Exec(q.deleteExpiredActResp, kind, entityId, userId, key, at.UnixNano()); err != nil {
+			return false, nil, err
+		}
+		res, err := cdb.Exec(q.reserveActResp, kind, entityId, userId, key, []byte{}, deleteAfter.UnixNano())
+		if err != nil {
+			return false, nil, err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 1 {
+			return n == 1, nil, err
+		}
+		var resp []byte
+		err = cdb.QueryRow(q.selectActResp, kind, entityId, userId, key, at.UnixNano()).Scan(&resp)
+		if err == sql.ErrNoRows {
+			// released since the insert by a request that failed, answered as still in progress so the client tries again
+			return false, nil, nil
+		}
+		return false, resp, err
+	}
+
+	removeActResp := func(entityId string, userId string, key string) error {
+		_, err := cdb.Exec(q.deleteActResp, kind, entityId, userId, key)
+		return err
+	}
+
+	readVersion := func(entityId string) (int, error) {
+		var version int
+		err := cdb.QueryRow(q.selectVersion, entityId, kind).Scan(&version)
+		if err == sql.ErrNoRows {
+			return 0, &nonExtantError{&entityDoesNotExistError{entityId}}
+		}
+		return version, err
+	}
+
+	inner := &sqlStore{cdb, q, kind, deleteAfter, cfg.storedTTL, cfg.clock, sid.Uuid, func()sus.Version{
+		e := ef()
+		e.SetDeleteAfter(cfg.clock.Now().Add(cfg.storedTTL(e, deleteAfter)))
+		return e
+	}, cfg.initializer(ei)}
+
+	b := &backend{
+		list: list,
+		put: put,
+		appendLog: appendLog,
+		readLog: readLog,
+		putHistory: putHistory,
+		readHistory: readHistory,
+		resumeGeneration: resumeGeneration,
+		claimResumeGeneration: claimResumeGeneration,
+		setOpen: setOpen,
+		listOpen: listOpen,
+		putLobby: putLobby,
+		removeLobby: removeLobby,
+		listLobby: listLobby,
+		putLifetime: putLifetime,
+		readLifetime: readLifetime,
+		putActResp: putActResp,
+		reserveActResp: reserveActResp,
+		removeActResp: removeActResp,
+		readVersion: readVersion,
+	}
+
+	return newEntityStore(ef, deleteAfter, clearOut, b, inner, cfg)
+}
+
+type sqlQueries struct{
+	insert					string
+	selectPayload			string
+	selectExists			string
+	selectVersion			string
+	selectLive				string
+	update					string
+	delete					string
+	deleteExpired			string
+	selectExpired			string
+	deleteVersion			string
+	insertLog				string
+	deleteLog				string
+	selectLog				string
+	deleteOrphanedLogs		string
+	insertHistory			string
+	selectHistory			string
+	trimHistory				string
+	deleteHistory			string
+	deleteHistoryVersion	string
+	deleteOrphanedHistory	string
+	selectResume			string
+	insertResume			string
+	claimResume				string
+	deleteResume			string
+	deleteOrphanedResume	string
+	insertOpen				string
+	deleteOpen				string
+	selectOpen				string
+	deleteOrphanedOpen		string
+	insertLobby				string
+	updateLobby				string
+	deleteLobby				string
+	selectLobby				string
+	deleteOrphanedLobby		string
+	insertLifetime			string
+	updateLifetime			string
+	selectLifetime			string
+	deleteLifetime			string
+	deleteOverLifetime		string
+	deleteOrphanedLifetime	string
+	selectActResp			string
+	insertActResp			string
+	reserveActResp			string
+	deleteActResp			string
+	deleteExpiredActResp	string
+	deleteActResps			string
+	deleteExpiredActResps	string
+	deleteOrphanedActResps	string
+}
+
+func placeholders(d SqlDialect, n int) string {
+	ps := make([]string, n)
+	for i := range ps {
+		ps[i] = d.Placeholder(i + 1)
+	}
+	return strings.Join(ps, `, `)
+}
+
+func newSqlQueries(d SqlDialect, table string) *sqlQueries {
+	p := d.Placeholder
+	return &sqlQueries{
+		insert: `INSERT INTO ` + table + ` (id, kind, version, delete_after, payload) VALUES (` + p(1) + `, ` + p(2) + `, ` + p(3) + `, ` + p(4) + `, ` + p(5) + `)`,
+		selectPayload: `SELECT payload FROM ` + table + ` WHERE id = ` + p(1) + ` AND kind = ` + p(2),
+		selectExists: `SELECT 1 FROM ` + table + ` WHERE id = ` + p(1) + ` AND kind = ` + p(2),
+		selectVersion: `SELECT version FROM ` + table + ` WHERE id = ` + p(1) + ` AND kind = ` + p(2),
+		selectLive: `SELECT id, delete_after FROM ` + table + ` WHERE kind = ` + p(1) + ` AND delete_after > ` + p(2),
+		update: `UPDATE ` + table + ` SET version = ` + p(1) + `, delete_after = ` + p(2) + `, payload = ` + p(3) + ` WHERE id = ` + p(4) + ` AND kind = ` + p(5) + ` AND version = ` + p(6),
+		delete: `DELETE FROM ` + table + ` WHERE id = ` + p(1) + ` AND kind = ` + p(2),
+		deleteExpired: `DELETE FROM ` + table + ` WHERE kind = ` + p(1) + ` AND delete_after <= ` + p(2),
+		selectExpired: `SELECT id, version, payload FROM ` + table + ` WHERE kind = ` + p(1) + ` AND (delete_after <= ` + p(2) + ` OR id IN (SELECT entity_id FROM ` + table + `_lifetime WHERE kind = ` + p(3) + ` AND created_at <= ` + p(4) + `))`,
+		deleteVersion: `DELETE FROM ` + table + ` WHERE id = ` + p(1) + ` AND kind = ` + p(2) + ` AND version = ` + p(3),
+		insertLog: `INSERT INTO ` + table + `_log (kind, entity_id, version, user_id, act, snapshot, at) VALUES (` + p(1) + `, ` + p(2) + `, ` + p(3) + `, ` + p(4) + `, ` + p(5) + `, ` + p(6) + `, ` + p(7) + `)`,
+		deleteLog: `DELETE FROM ` + table + `_log WHERE kind = ` + p(1) + ` AND entity_id = ` + p(2),
+		selectLog: `SELECT version, user_id, act, snapshot, at FROM ` + table + `_log WHERE kind = ` + p(1) + ` AND entity_id = ` + p(2) + ` ORDER BY version`,
+		deleteOrphanedLogs: `DELETE FROM ` + table + `_log WHERE kind = ` + p(1) + ` AND entity_id NOT IN (SELECT id FROM ` + table + ` WHERE kind = ` + p(2) + `)`,
+		insertHistory: `INSERT INTO ` + table + `_history (kind, entity_id, version, payload) VALUES (` + p(1) + `, ` + p(2) + `, ` + p(3) + `, ` + p(4) + `)`,
+		selectHistory: `SELECT payload FROM ` + table + `_history WHERE kind = ` + p(1) + ` AND entity_id = ` + p(2) + ` AND version = ` + p(3),
+		trimHistory: `DELETE FROM ` + table + `_history WHERE kind = ` + p(1) + ` AND entity_id = ` + p(2) + ` AND version <= ` + p(3),
+		deleteHistory: `DELETE FROM ` + table + `_history WHERE kind = ` + p(1) + ` AND entity_id = ` + p(2),
+		deleteHistoryVersion: `DELETE FROM ` + table + `_history WHERE kind = ` + p(1) + ` AND entity_id = ` + p(2) + ` AND version = ` + p(3),
+		deleteOrphanedHistory: `DELETE FROM ` + table + `_history WHERE kind = ` + p(1) + ` AND entity_id NOT IN (SELECT id FROM ` + table + ` WHERE kind = ` + p(2) + `)`,
+		selectResume: `SELECT generation FROM ` + table + `_resume WHERE kind = ` + p(1) + ` AND entity_id = ` + p(2) + ` AND user_id = ` + p(3),
+		insertResume: d.InsertIfAbsent(table + `_resume`, []string{`kind`, `entity_id`, `user_id`, `generation`}),
+		claimResume: `UPDATE ` + table + `_resume SET generation = generation + 1 WHERE kind = ` + p(1) + ` AND entity_id = ` + p(2) + ` AND user_id = ` + p(3) + ` AND generation = ` + p(4),
+		deleteResume: `DELETE FROM ` + table + `_resume WHERE kind = ` + p(1) + ` AND entity_id = ` + p(2),
+		deleteOrphanedResume: `DELETE FROM ` + table + `_resume WHERE kind = ` + p(1) + ` AND entity_id NOT IN (SELECT id FROM ` + table + ` WHERE kind = ` + p(2) + `)`,
+		insertOpen: `INSERT INTO ` + table + `_open (kind, entity_id) VALUES (` + p(1) + `, ` + p(2) + `)`,
+		deleteOpen: `DELETE FROM ` + table + `_open WHERE kind = ` + p(1) + ` AND entity_id = ` + p(2),
+		selectOpen: `SELECT o.entity_id FROM ` + table + `_open o JOIN ` + table + ` e ON e.kind = o.kind AND e.id = o.entity_id WHERE o.kind = ` + p(1) + ` AND e.delete_after > ` + p(2),
+		deleteOrphanedOpen: `DELETE FROM ` + table + `_open WHERE kind = ` + p(1) + ` AND entity_id NOT IN (SELECT id FROM ` + table + ` WHERE kind = ` + p(2) + `)`,
+		insertLobby: `INSERT INTO ` + table + `_lobby (kind, entity_id, created_at, created_by, players, summary, delete_after) VALUES (` + p(1) + `, ` + p(2) + `, ` + p(3) + `, ` + p(4) + `, ` + p(5) + `, ` + p(6) + `, ` + p(7) + `)`,
+		updateLobby: `UPDATE ` + table + `_lobby SET created_by = ` + p(1) + `, players = ` + p(2) + `, summary = ` + p(3) + `, delete_after = ` + p(4) + ` WHERE kind = ` + p(5) + ` AND entity_id = ` + p(6),
+		deleteLobby: `DELETE FROM ` + table + `_lobby WHERE kind = ` + p(1) + ` AND entity_id = ` + p(2),
+		selectLobby: `SELECT entity_id, created_at, created_by, players, summary FROM ` + table + `_lobby WHERE kind = ` + p(1) + ` AND delete_after > ` + p(2) + ` AND (created_at > ` + p(3) + ` OR (created_at = ` + p(4) + ` AND entity_id > ` + p(5) + `)) ORDER BY created_at, entity_id LIMIT ` + p(6),
+		deleteOrphanedLobby: `DELETE FROM ` + table + `_lobby WHERE kind = ` + p(1) + ` AND entity_id NOT IN (SELECT id FROM ` + table + ` WHERE kind = ` + p(2) + `)`,
+		insertLifetime: `INSERT INTO ` + table + `_lifetime (kind, entity_id, created_at, idle_until) VALUES (` + p(1) + `, ` + p(2) + `, ` + p(3) + `, ` + p(4) + `)`,
+		updateLifetime: `UPDATE ` + table + `_lifetime SET idle_until = ` + p(1) + ` WHERE kind = ` + p(2) + ` AND entity_id = ` + p(3),
+		selectLifetime: `SELECT created_at, idle_until FROM ` + table + `_lifetime WHERE kind = ` + p(1) + ` AND entity_id = ` + p(2),
+		deleteLifetime: `DELETE FROM ` + table + `_lifetime WHERE kind = ` + p(1) + ` AND entity_id = ` + p(2),
+		deleteOverLifetime: `DELETE FROM ` + table + ` WHERE kind = ` + p(1) + ` AND id IN (SELECT entity_id FROM ` + table + `_lifetime WHERE kind = ` + p(2) + ` AND created_at <= ` + p(3) + `)`,
+		deleteOrphanedLifetime: `DELETE FROM ` + table + `_lifetime WHERE kind = ` + p(1) + ` AND entity_id NOT IN (SELECT id FROM ` + table + ` WHERE kind = ` + p(2) + `)`,
+		selectActResp: `SELECT resp FROM ` + table + `_act_resp WHERE kind = ` + p(1) + ` AND entity_id = ` + p(2) + ` AND user_id = ` + p(3) + ` AND idempotency_key = ` + p(4) + ` AND delete_after > ` + p(5),
+		insertActResp: `INSERT INTO ` + table + `_act_resp (kind, entity_id, user_id, idempotency_key, resp, delete_after) VALUES (` + p(1) + `, ` + p(2) + `, ` + p(3) + `, ` + p(4) + `, ` + p(5) + `, ` + p(6) + `)`,
+		reserveActResp: d.InsertIfAbsent(table + `_act_resp`, []string{`kind`, `entity_id`, `user_id`, `idempotency_key`, `resp`, `delete_after`}),
+		deleteActResp: `DELETE FROM ` + table + `_act_resp WHERE kind = ` + p(1) + ` AND entity_id = ` + p(2) + ` AND user_id = ` + p(3) + ` AND idempotency_key = ` + p(4),
+		deleteExpiredActResp: `DELETE FROM ` + table + `_act_resp WHERE kind = ` + p(1) + ` AND entity_id = ` + p(2) + ` AND user_id = ` + p(3) + ` AND idempotency_key = ` + p(4) + ` AND delete_after <= ` + p(5),
+		deleteActResps: `DELETE FROM ` + table + `_act_resp WHERE kind = ` + p(1) + ` AND entity_id = ` + p(2),
+		deleteExpiredActResps: `DELETE FROM ` + table + `_act_resp WHERE kind = ` + p(1) + ` AND delete_after <= ` + p(2),
+		deleteOrphanedActResps: `DELETE FROM ` + table + `_act_resp WHERE kind = ` + p(1) + ` AND entity_id NOT IN (SELECT id FROM ` + table + ` WHERE kind = ` + p(2) + `)`,
+	}
+}
+
+type sqlStore struct{
+	db				*contextDB
+	q				*sqlQueries
+	kind			string
+	deleteAfter		time.Duration
+	storedTTL		func(v interface{}, deleteAfter time.Duration) time.Duration
+	clock			Clock
+	idFactory		sus.IdFactory
+	versionFactory	sus.VersionFactory
+	initializer		sus.EntityInitializer
+}
+
+func (s *sqlStore) Create() (id string, v sus.Version, err error) {
+	ids, vs, err := s.CreateMulti(1)
+	if len(ids) == 1 && len(vs) == 1 {
+		id = ids[0]
+		v = vs[0]
+	}
+	return
+}
+
+func (s *sqlStore) CreateMulti(count uint) (ids []string, vs []sus.Version, err error) {
+	if count == 0 {
+		return
+	}
+	err = s.runInTransaction(func(tx *sql.Tx) error {
+		ids = make([]string, count, count)
+		vs = make([]sus.Version, count, count)
+		for i := 0; i < int(count); i++ {
+			ids[i] = s.idFactory()
+			vs[i] = s.initializer(s.versionFactory())
+			payload, err := json.Marshal(vs[i])
+			if err != nil {
+				return err
+			}
+			if _, err = tx.Exec(s.q.insert, ids[i], s.kind, vs[i].GetVersion(), s.clock.Now().Add(s.storedTTL(vs[i], s.deleteAfter)).UnixNano(), payload); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		ids, vs = nil, nil
+	}
+	return
+}
+
+func (s *sqlStore) Read(id string) (v sus.Version, err error) {
+	vs, err := s.ReadMulti([]string{id})
+	if len(vs) == 1 {
+		v = vs[0]
+	}
+	return
+}
+
+func (s *sqlStore) ReadMulti(ids []string) (vs []sus.Version, err error) {
+	if len(ids) == 0 {
+		return
+	}
+	vs = make([]sus.Version, len(ids), len(ids))
+	for i, id := range ids {
+		var payload []byte
+		if err = s.db.QueryRow(s.q.selectPayload, id, s.kind).Scan(&payload); err != nil {
+			if err == sql.ErrNoRows {
+				err = &nonExtantError{&entityDoesNotExistError{id}}
+			}
+			break
+		}
+		vs[i] = s.versionFactory()
+		if err = json.Unmarshal(payload, vs[i]); err != nil {
+			break
+		}
+	}
+	if err != nil {
+		vs = nil
+	}
+	return
+}
+
+func (s *sqlStore) Update(id string, v sus.Version) error {
+	return s.UpdateMulti([]string{id}, []sus.Version{v})
+}
+
+func (s *sqlStore) UpdateMulti(ids []string, vs []sus.Version) error {
+	if len(ids) != len(vs) {
+		return errors.New(`id count (` + strconv.Itoa(len(ids)) + `) not equal to entity count (` + strconv.Itoa(len(vs)) + `)`)
+	}
+	incremented := 0
+	err := s.runInTransaction(func(tx *sql.Tx) error {
+		for i, id := range ids {
+			oldVersion := vs[i].GetVersion()
+			vs[i].IncrementVersion()
+			incremented++
+			payload, err := json.Marshal(vs[i])
+			if err != nil {
+				return err
+			}
+			res, err := tx.Exec(s.q.update, vs[i].GetVersion(), s.clock.Now().Add(s.storedTTL(vs[i], s.deleteAfter)).UnixNano(), payload, id, s.kind, oldVersion)
+			if err != nil {
+				return err
+			}
+			if n, err := res.RowsAffected(); err != nil {
+				return err
+			} else if n == 0 {
+				var exists int
+				if err = tx.QueryRow(s.q.selectExists, id, s.kind).Scan(&exists); err == sql.ErrNoRows {
+					return &nonExtantError{&entityDoesNotExistError{id}}
+				} else if err != nil {
+					return err
+				}
+				return &nonsequentialUpdateError{id}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		for i := 0; i < incremented; i++ {
+			vs[i].DecrementVersion()
+		}
+	}
+	return err
+}
+
+func (s *sqlStore) Delete(id string) error {
+	return s.DeleteMulti([]string{id})
+}
+
+func (s *sqlStore) DeleteMulti(ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return s.runInTransaction(func(tx *sql.Tx) error {
+		for _, id := range ids {
+			if _, err := tx.Exec(s.q.delete, id, s.kind); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(s.q.deleteLog, s.kind, id); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(s.q.deleteHistory, s.kind, id); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(s.q.deleteResume, s.kind, id); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(s.q.deleteOpen, s.kind, id); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(s.q.deleteLobby, s.kind, id); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(s.q.deleteLifetime, s.kind, id); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(s.q.deleteActResps, s.kind, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sqlStore) runInTransaction(tran func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = tran(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func RouteSql(router *mux.Router, ef EntityFactory, ei EntityInitializer, sessionMaxAge int, sessionName string, newAuthKey string, newCryptKey string, oldAuthKey string, oldCryptKey string, entity Entity, getJoinResp oak.GetJoinResp, getEntityChangeResp oak.GetEntityChangeResp, performAct oak.PerformAct, deleteAfter time.Duration, clearOutAfter time.Duration, kind string, db *sql.DB, dialect SqlDialect, table string, opts ...Option) (*Routes, error) {
+	if kind == `` {
+		return nil, errors.New(`kind must not be an empty string`)
+	}
+	if deleteAfter.Seconds() <= 0 {
+		return nil, errors.New(`deleteAfter must be a positive time.Duration`)
+	}
+	if clearOutAfter.Seconds() <= 0 {
+		return nil, errors.New(`clearOutAfter must be a positive time.Duration`)
+	}
+	if db == nil {
+		return nil, errors.New(`db must not be nil`)
+	}
+	if dialect == nil {
+		return nil, errors.New(`dialect must not be nil`)
+	}
+	if table == `` {
+		return nil, errors.New(`table must not be an empty string`)
+	}
+	cfg := newConfig(opts)
+	cfg.requireCloner(entity)
+	if cfg.err != nil {
+		return nil, cfg.err
+	}
+	for _, stmt := range dialect.CreateTable(table) {
+		if _, err := db.Exec(stmt); err != nil {
+			return nil, err
+		}
+	}
+
+	sessionStore := initCookieSessionStore(sessionMaxAge, newAuthKey, newCryptKey, oldAuthKey, oldCryptKey)
+	storeForContext := func(ctx context.Context) *entityStore {
+		return newSqlStore(db, ctx, dialect, table, kind, ef, ei, deleteAfter, clearOutAfter, cfg).(*entityStore)
+	}
+	return route(router, sessionStore, sessionName, []byte(newAuthKey), entity, storeForContext, requestContext, getJoinResp, getEntityChangeResp, performAct, cfg), nil
+}
@@ -0,0 +1,199 @@
+package joak
+
+import(
+	`os`
+	`log`
+	`time`
+	`bytes`
+	`testing`
+	`database/sql`
+	`github.com/gorilla/mux`
+	`golang.org/x/net/context`
+	_ `github.com/mattn/go-sqlite3`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_RouteSql(t *testing.T){
+	dur1, _ := time.ParseDuration(`-1s`)
+	dur2, _ := time.ParseDuration(`1s`)
+	db := &sql.DB{}
+
+	_, err := RouteSql(mux.NewRouter(), nil, nil, 300, ``, ``, ``, ``, `test`, &testEntity{}, nil, nil, nil, dur1, dur1, ``, nil, nil, ``)
+
+	assert.Equal(t, `kind must not be an empty string`, err.Error(), `err should contain appropriate message`)
+
+	_, err = RouteSql(mux.NewRouter(), nil, nil, 300, ``, ``, ``, ``, `test`, &testEntity{}, nil, nil, nil, dur1, dur1, `test`, nil, nil, ``)
+
+	assert.Equal(t, `deleteAfter must be a positive time.Duration`, err.Error(), `err should contain appropriate message`)
+
+	_, err = RouteSql(mux.NewRouter(), nil, nil, 300, ``, ``, ``, ``, `test`, &testEntity{}, nil, nil, nil, dur2, dur1, `test`, nil, nil, ``)
+
+	assert.Equal(t, `clearOutAfter must be a positive time.Duration`, err.Error(), `err should contain appropriate message`)
+
+	_, err = RouteSql(mux.NewRouter(), nil, nil, 300, ``, ``, ``, ``, `test`, &testEntity{}, nil, nil, nil, dur2, dur2, `test`, nil, nil, ``)
+
+	assert.Equal(t, `db must not be nil`, err.Error(), `err should contain appropriate message`)
+
+	_, err = RouteSql(mux.NewRouter(), nil, nil, 300, ``, ``, ``, ``, `test`, &testEntity{}, nil, nil, nil, dur2, dur2, `test`, db, nil, ``)
+
+	assert.Equal(t, `dialect must not be nil`, err.Error(), `err should contain appropriate message`)
+
+	_, err = RouteSql(mux.NewRouter(), nil, nil, 300, ``, ``, ``, ``, `test`, &testEntity{}, nil, nil, nil, dur2, dur2, `test`, db, SqliteDialect, ``)
+
+	assert.Equal(t, `table must not be an empty string`, err.Error(), `err should contain appropriate message`)
+}
+
+func Test_SqlQueries(t *testing.T){
+	q := newSqlQueries(SqliteDialect, `joak`)
+
+	assert.Equal(t, `UPDATE joak SET version = ?, delete_after = ?, payload = ? WHERE id = ? AND kind = ? AND version = ?`, q.update, `update should be conditional on version`)
+	assert.Equal(t, `DELETE FROM joak WHERE kind = ? AND delete_after <= ?`, q.deleteExpired, `deleteExpired should be a single delete statement`)
+	assert.Equal(t, `INSERT OR IGNORE INTO joak_resume (kind, entity_id, user_id, generation) VALUES (?, ?, ?, ?)`, q.insertResume, `insertResume should come from the dialect`)
+
+	q = newSqlQueries(PostgresDialect, `joak`)
+
+	assert.Equal(t, `UPDATE joak SET version = $1, delete_after = $2, payload = $3 WHERE id = $4 AND kind = $5 AND version = $6`, q.update, `update should use numbered placeholders`)
+	assert.Equal(t, `DELETE FROM joak WHERE kind = $1 AND delete_after <= $2`, q.deleteExpired, `deleteExpired should use numbered placeholders`)
+	assert.Equal(t, `INSERT INTO joak_resume (kind, entity_id, user_id, generation) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING`, q.insertResume, `insertResume should come from the dialect`)
+}
+
+func Test_SqlStore(t *testing.T){
+	db := newTestSqlDb(t)
+	defer db.Close()
+	s := newSqlStore(db, context.Background(), SqliteDialect, `joak`, `Test_SqlStore`, func()Entity{return &testEntity{}}, func(e Entity)Entity{return e}, time.Minute, time.Minute, newConfig(nil))
+
+	id, e, err := s.Create()
+
+	assert.Equal(t, 0, e.GetVersion(), `entity Version should be 0`)
+	assert.Nil(t, err, `err should be nil`)
+
+	err = s.Update(`not an id`, e)
+
+	assert.Equal(t, 0, e.GetVersion(), `entity Version should be 0`)
+	assert.Equal(t, `Non extant error, inner error message: entity with id "not an id" does not exist`, err.Error(), `err should have appropriate message`)
+
+	err = s.Update(id, e)
+
+	assert.Equal(t, 1, e.GetVersion(), `entity Version should be 1`)
+	assert.Nil(t, err, `err should be nil`)
+
+	stale := &testEntity{}
+	err = s.Update(id, stale)
+
+	assert.Equal(t, 0, stale.GetVersion(), `entity Version should be restored after a failed update`)
+	assert.Equal(t, `nonsequential update for entity with id "` + id + `"`, err.Error(), `err should have appropriate message`)
+
+	var version int
+	db.QueryRow(`SELECT version FROM joak WHERE id = ?`, id).Scan(&version)
+
+	assert.Equal(t, 1, version, `a nonsequential update should not be written`)
+
+	e, err = s.Read(id)
+
+	assert.Equal(t, 1, e.GetVersion(), `entity Version should be 1`)
+	assert.Nil(t, err, `err should be nil`)
+}
+
+func Test_SqlStore_ClearOut(t *testing.T){
+	db := newTestSqlDb(t)
+	defer db.Close()
+	clock := NewFakeClock(time.Date(2015, 7, 29, 0, 0, 0, 0, time.UTC))
+	s := newSqlStore(db, context.Background(), SqliteDialect, `joak`, `Test_SqlStore_ClearOut`, func()Entity{return &testEntity{}}, func(e Entity)Entity{return e}, time.Minute, time.Minute, newConfig([]Option{WithClock(clock)})).(*entityStore)
+
+	expired, _, _ := s.Create()
+	s.appendLog([]*ActionLogEntry{{EntityId: expired, Snapshot: []byte(`{}`), At: clock.Now()}})
+	clock.Advance(30 * time.Second)
+	live, _, _ := s.Create()
+	clock.Advance(30 * time.Second)
+	s.clearOut()
+	_, err := s.Read(expired)
+
+	assert.True(t, isNonExtantError(err), `an expired entity should be deleted`)
+
+	_, err = s.Read(live)
+
+	assert.Nil(t, err, `a live entity should not be deleted`)
+
+	entries, _ := s.readLog(expired)
+
+	assert.Equal(t, 0, len(entries), `logs of expired entities should be deleted`)
+
+	buf := &bytes.Buffer{}
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+	db.Exec(`DROP TABLE joak_log`)
+	clock.Advance(time.Minute)
+	s.clearOut()
+
+	assert.Contains(t, buf.String(), `joak: clear out of kind "Test_SqlStore_ClearOut" in table "joak" failed`, `clear out errors should be logged`)
+}
+
+func Test_SqlStore_WithLifetime(t *testing.T){
+	db := newTestSqlDb(t)
+	clock := NewFakeClock(now())
+	s := newSqlStore(db, context.Background(), SqliteDialect, `joak`, `test`, func()Entity{return &testEntity{}}, func(e Entity)Entity{return e}, time.Hour, time.Hour, newConfig([]Option{WithClock(clock), WithLifetime(10 * time.Minute, 0)})).(*entityStore)
+	end := clock.Now().Add(10 * time.Minute)
+
+	id, e, err := s.Create()
+	_, deleteAfters, _ := s.list(clock.Now())
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, []time.Time{end}, deleteAfters, `the stored delete_after should be capped at the maximum lifetime on create`)
+	assert.Equal(t, end, e.(*testEntity).DeleteAfter, `DeleteAfter should be capped at the maximum lifetime on create`)
+
+	clock.Advance(5 * time.Minute)
+	err = s.Update(id, e)
+	_, deleteAfters, _ = s.list(clock.Now())
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, []time.Time{end}, deleteAfters, `the stored delete_after should be capped at the maximum lifetime on update`)
+}
+
+func Test_SqlStore_reserveActResp(t *testing.T){
+	db := newTestSqlDb(t)
+	clock := NewFakeClock(now())
+	s := newSqlStore(db, context.Background(), SqliteDialect, `joak`, `test`, func()Entity{return &testEntity{}}, func(e Entity)Entity{return e}, time.Hour, time.Hour, newConfig([]Option{WithClock(clock)})).(*entityStore)
+	id, _, _ := s.Create()
+	at := clock.Now()
+
+	reserved, _, err := s.reserveActResp(id, `u`, `k`, at, at.Add(time.Minute))
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.True(t, reserved, `the first request with a key should reserve it`)
+
+	reserved, resp, err := s.reserveActResp(id, `u`, `k`, at, at.Add(time.Minute))
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.False(t, reserved, `a reserved key should not be reserved again`)
+	assert.Equal(t, 0, len(resp), `a key still being handled should have no response`)
+
+	s.putActResp(id, `u`, `k`, []byte(`{}`), at.Add(time.Minute))
+	reserved, resp, _ = s.reserveActResp(id, `u`, `k`, at, at.Add(time.Minute))
+
+	assert.False(t, reserved, `a remembered key should not be reserved again`)
+	assert.Equal(t, `{}`, string(resp), `a remembered key should have its response`)
+
+	s.removeActResp(id, `u`, `k`)
+	reserved, _, _ = s.reserveActResp(id, `u`, `k`, at, at.Add(time.Minute))
+
+	assert.True(t, reserved, `a released key should be reserved again`)
+
+	reserved, _, _ = s.reserveActResp(id, `u`, `k`, at.Add(time.Minute), at.Add(2 * time.Minute))
+
+	assert.True(t, reserved, `an expired key should be reserved again`)
+}
+
+func newTestSqlDb(t *testing.T) *sql.DB {
+	db, err := sql.Open(`sqlite3`, `:memory:`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every connection to :memory: is a separate database
+	db.SetMaxOpenConns(1)
+	for _, stmt := range SqliteDialect.CreateTable(`joak`) {
+		if _, err = db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
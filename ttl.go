@@ -0,0 +1,18 @@
+package joak
+
+import(
+	`time`
+)
+
+// Implemented by entities that need a different lifetime to the deleteAfter their routes were set up with,
+// a TTL of zero or less falls back to that deleteAfter.
+type TTLer interface{
+	TTL() time.Duration
+}
+
+func entityTTL(v interface{}, deleteAfter time.Duration) time.Duration {
+	if ttl, ok := v.(TTLer); ok && ttl.TTL() > 0 {
+		return ttl.TTL()
+	}
+	return deleteAfter
+}
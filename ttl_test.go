@@ -0,0 +1,48 @@
+package joak
+
+import(
+	`time`
+	`testing`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_MemoryStore_TTL(t *testing.T){
+	clock := NewFakeClock(now())
+	dur, _ := time.ParseDuration(`1m`)
+	ef := func()Entity{return &ttlTestEntity{}}
+	ei := func(e Entity)Entity{
+		e.(*ttlTestEntity).Lifetime = time.Hour
+		return e
+	}
+	s := newMemoryStore(ef, ei, dur, newConfig([]Option{WithClock(clock)})).(*entityStore)
+
+	id, e, _ := s.Create()
+	_, deleteAfters, _ := s.list(clock.Now())
+
+	assert.Equal(t, clock.Now().Add(time.Hour), e.(*ttlTestEntity).DeleteAfter, `create should use the entity ttl`)
+	assert.Equal(t, clock.Now().Add(time.Hour), deleteAfters[0], `create should use the entity ttl`)
+
+	clock.Advance(30 * time.Minute)
+	e.(*ttlTestEntity).Lifetime = 0
+	s.Update(id, e)
+	_, deleteAfters, _ = s.list(clock.Now())
+
+	assert.Equal(t, clock.Now().Add(dur), e.(*ttlTestEntity).DeleteAfter, `update should fall back to deleteAfter without a ttl`)
+	assert.Equal(t, clock.Now().Add(dur), deleteAfters[0], `update should fall back to deleteAfter without a ttl`)
+
+	e.(*ttlTestEntity).Lifetime = 5 * time.Minute
+	s.Update(id, e)
+	clock.Advance(6 * time.Minute)
+	ids, _, _ := s.list(clock.Now())
+
+	assert.Equal(t, 0, len(ids), `entities should expire after their ttl`)
+}
+
+type ttlTestEntity struct{
+	testEntity
+	Lifetime	time.Duration
+}
+
+func (e *ttlTestEntity) TTL() time.Duration {
+	return e.Lifetime
+}